@@ -26,3 +26,25 @@ CREATE TABLE `follow_map` (
   `created_at` datetime NOT NULL,
   PRIMARY KEY (`user`, `target`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `thumbnail_jobs`;
+CREATE TABLE `thumbnail_jobs` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `kind` varchar(16) NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `state` varchar(16) NOT NULL default 'pending',
+  `attempts` int(11) NOT NULL default 0,
+  `last_error` text,
+  `created_at` datetime NOT NULL,
+  `updated_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `thumbnail_jobs_state` (`state`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `entry_metadata`;
+CREATE TABLE `entry_metadata` (
+  `entry_id` int(11) NOT NULL,
+  `data` text NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`entry_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
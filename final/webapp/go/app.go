@@ -1,11 +1,15 @@
 package main
 
 import (
+	"./imaging"
+	"./storage"
+	"./thumbnail"
 	"code.google.com/p/go-uuid/uuid"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
@@ -15,7 +19,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -24,22 +27,14 @@ import (
 
 const (
 	listenAddr = ":5000"
-	tmpDir     = "/tmp/"
 
-	timeout  = 30
-	interval = 2
-
-	iconS  = 32
-	iconM  = 64
-	iconL  = 128
-	imageS = 128
-	imageM = 256
-	imageL = -1
+	timeout = 30
 )
 
 var (
-	dbConn  *sql.DB
-	config  *Config
+	dbConn *sql.DB
+	config *Config
+	blobs  storage.BlobStore
 )
 
 type Config struct {
@@ -50,7 +45,16 @@ type Config struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"database"`
-	Datadir string `json:"data_dir"`
+	Datadir    string          `json:"data_dir"`
+	Storage    storage.Config  `json:"storage"`
+	Image      imaging.Options `json:"image"`
+	Thumbnails JobConfig       `json:"thumbnails"`
+	Resize     ResizeConfig    `json:"resize"`
+	Upload     UploadConfig    `json:"upload"`
+	TLS        TLSConfig       `json:"tls"`
+	Compress   CompressConfig  `json:"compress"`
+	GC         GCConfig        `json:"gc"`
+	Timeline   TimelineConfig  `json:"timeline"`
 }
 
 type User struct {
@@ -141,6 +145,11 @@ func main() {
 
 	rand.Seed(time.Now().Unix())
 
+	fromDisk := flag.Bool("disk", false, "serve ./public/ from disk instead of the embedded copy")
+	gcOnce := flag.Bool("gc", false, "reconcile the stored images and icons with the database once and exit")
+	dryRun := flag.Bool("dry-run", false, "with -gc, only report what would be deleted")
+	flag.Parse()
+
 	env := os.Getenv("ISUCON_ENV")
 	if env == "" {
 		env = "local"
@@ -158,22 +167,48 @@ func main() {
 	if err != nil {
 		log.Panicf("Error opening database: %v", err)
 	}
+	blobs, err = storage.New(config.Storage, config.Datadir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *gcOnce {
+		report, err := collectGarbage(blobs, *dryRun, config.GC.grace())
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.print(os.Stdout)
+		return
+	}
+	thumbnails = newJobQueue(config.Thumbnails)
+	if config.GC.Interval > 0 {
+		go runGC(config.GC)
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/signup", signupHandler).Methods("POST")
 	r.HandleFunc("/me", meHandler).Methods("GET")
 	r.HandleFunc("/entry/{id}", deleteEntryHandler).Methods("POST")
+	r.HandleFunc("/entry/{id}/metadata", entryMetadataHandler).Methods("GET")
 	r.HandleFunc("/entry", entryHandler).Methods("POST")
 	r.HandleFunc("/timeline", timelineHandler).Methods("GET")
+	r.HandleFunc("/timeline/stream", timelineStreamHandler).Methods("GET")
 	r.HandleFunc("/icon/{icon}", iconHandler).Methods("GET")
 	r.HandleFunc("/icon", updateIconHandler).Methods("POST")
 	r.HandleFunc("/image/{image}", imageHandler).Methods("GET")
 	r.HandleFunc("/follow", followingHandler).Methods("GET")
 	r.HandleFunc("/follow", followHandler).Methods("POST")
 	r.HandleFunc("/unfollow", unfollowHandler).Methods("POST")
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
-	http.Handle("/", r)
-	http.ListenAndServe(listenAddr, nil)
+	if *fromDisk {
+		r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
+	} else {
+		assets, err := newAssetServer(embeddedPublic())
+		if err != nil {
+			log.Fatalf("can't load embedded assets: %v", err)
+		}
+		r.PathPrefix("/").Handler(assets)
+	}
+	http.Handle("/", compressHandler(r, config.Compress))
+	log.Fatal(listenAndServe(config.TLS, nil))
 }
 
 func serverError(w http.ResponseWriter, err error) {
@@ -207,138 +242,6 @@ func sha256Hex(a ...interface{}) string {
 	return hex.EncodeToString(md)
 }
 
-func convert(path string, ext string, w int, h int) ([]byte, error) {
-	f, err := ioutil.TempFile(tmpDir, "isucon")
-	if err != nil {
-		return nil, err
-	}
-	defer os.Remove(f.Name())
-
-	newFile := fmt.Sprintf("%s.%s", f.Name(), ext)
-
-	cmd := exec.Command("convert", "-geometry", fmt.Sprintf("%dx%d", w, h), path, newFile)
-	if err := cmd.Run(); err != nil {
-		return nil, err
-	}
-	defer os.Remove(newFile)
-
-	b, err := ioutil.ReadFile(newFile)
-	if err != nil {
-		return nil, err
-	}
-
-	return b, nil
-}
-
-func cropSquare(orig string, ext string) (string, error) {
-	str, err := exec.Command("identify", orig).Output()
-	if err != nil {
-		return "", err
-	}
-	size := regexp.MustCompile(" +").Split(string(str), 4)[2]
-	wh := regexp.MustCompile("x").Split(size, 2)
-	w, _ := strconv.Atoi(wh[0])
-	h, _ := strconv.Atoi(wh[1])
-	var crop_x float32
-	var crop_y float32
-	var pixels int
-	if w > h {
-		pixels = h
-		crop_x = (float32(w-pixels) / 2)
-		crop_y = 0
-	} else if w < h {
-		pixels = w
-		crop_x = 0
-		crop_y = (float32(h-pixels) / 2)
-	} else {
-		pixels = w
-		crop_x = 0
-		crop_y = 0
-	}
-	f, err := ioutil.TempFile(tmpDir, "isucon")
-	if err != nil {
-		return "", err
-	}
-	os.Remove(f.Name())
-
-	newFile := fmt.Sprintf("%s.%s", f.Name(), ext)
-	cmd := exec.Command("convert", "-crop", fmt.Sprintf("%vx%v+%v+%v", pixels, pixels, crop_x, crop_y), orig, newFile)
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-	return newFile, nil
-}
-
-func convertImage(orig string, target string, w int, h int) {
-	cmd := exec.Command("convert", "-quality", "70", "-define", fmt.Sprintf("jpeg:size=%dx%d", w, h), "-geometry", fmt.Sprintf("%dx%d", w, h), orig, target)
-	if err := cmd.Run(); err != nil {
-		panic(err.Error())
-	}
-}
-
-func makeImageThumbnails(dir string, name string) {
-	m := regexp.MustCompile("^([0-9a-f]+)(_(?:s|m|l))?.jpg$").FindStringSubmatch(name)
-	if m == nil {
-		return
-	}
-	if m[2] != "" {
-		return
-	}
-
-	hash := m[1]
-	sizes := []string{"s", "m"}
-	for _, size := range sizes {
-		target := fmt.Sprintf("%s/%s_%s.jpg", dir, hash, size)
-		if FileExists(target) {
-			log.Printf("%s exists", target)
-			continue
-		}
-		orig := fmt.Sprintf("%s/%s", dir, name)
-		square, err := cropSquare(orig, "jpg")
-		if err != nil {
-			panic(err.Error())
-		}
-		switch size {
-		case "s":
-			convertImage(square, target, imageS, imageS)
-		case "m":
-			convertImage(square, target, imageM, imageM)
-		}
-	}
-}
-
-func makeIconThumbnails(dir string, name string) {
-	m := regexp.MustCompile("^([0-9a-f]+)(_(?:s|m|l))?.png$").FindStringSubmatch(name)
-	if m == nil {
-		return
-	}
-	if m[2] != "" {
-		return
-	}
-
-	hash := m[1]
-	sizes := []string{"s", "m", "l"}
-	for _, size := range sizes {
-		target := fmt.Sprintf("%s/%s_%s.png", dir, hash, size)
-		if FileExists(target) {
-			log.Printf("%s exists", target)
-			continue
-		}
-		orig := fmt.Sprintf("%s/%s", dir, name)
-		switch size {
-		case "s":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(orig, target, iconS, iconS)
-		case "m":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(orig, target, iconM, iconM)
-		case "l":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(orig, target, iconL, iconL)
-		}
-	}
-}
-
 func FileExists(name string) bool {
 	_, err := os.Stat(name)
 	return !os.IsNotExist(err)
@@ -429,36 +332,32 @@ func entryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uploadFile, handler, err := r.FormFile("image")
-	if err != nil {
-		serverError(w, err)
+	data, img, _, uerr := readUpload(w, r, "image", "jpeg")
+	if uerr != nil {
+		renderUploadError(w, uerr)
 		return
 	}
-	if handler == nil {
-		badRequest(w)
-		return
-	}
-
-	contentType := handler.Header.Get("Content-Type")
-	if !regexp.MustCompile("^image/jpe?g").MatchString(contentType) {
-		badRequest(w)
-		return
+	meta, err := imaging.ReadExif(data)
+	if err != nil {
+		log.Printf("ignoring broken EXIF data: %v", err)
 	}
-
-	data, err := ioutil.ReadAll(uploadFile)
+	data, err = storedImage(data, img, meta)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
 	imageId := sha256Hex(uuid.NewUUID())
-	err = ioutil.WriteFile(config.Datadir+"/image/"+imageId+".jpg", data, 0666)
+	err = blobs.Put("image/"+imageId+".jpg", data, "image/jpeg")
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
-	makeImageThumbnails(config.Datadir+"/image", imageId+".jpg")
+	if err := thumbnails.enqueue(jobImage, imageId+".jpg"); err != nil {
+		serverError(w, err)
+		return
+	}
 
 	publishLevel := r.FormValue("publish_level")
 	result, err := dbConn.Exec(
@@ -475,6 +374,12 @@ func entryHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
+	if meta != nil && r.FormValue("keep_metadata") == "1" {
+		if err := saveMetadata(int(id), meta); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
 
 	entry := Entry{}
 	err = dbConn.QueryRow(
@@ -486,6 +391,7 @@ func entryHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
+	publishEntry(&entry)
 
 	renderJson(w, Response{
 		"id":            entry.Id,
@@ -517,88 +423,32 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) {
 		latestEntryId = 0
 	}
 
-	timeoutMessage := make(chan bool)
-	entriesMessage := make(chan []Response)
-
-	go func() {
-		time.Sleep(time.Second * timeout)
-		timeoutMessage <- true
-	}()
-
-	go func() {
-		for {
-			var (
-				rows *sql.Rows
-				err  error
-			)
-			if 0 < latestEntryId {
-				rows, err = dbConn.Query(
-					"SELECT * FROM (SELECT * FROM entries WHERE (user=? OR publish_level=2 OR (publish_level=1 AND user IN (SELECT target FROM follow_map WHERE user=?))) AND id > ? ORDER BY id LIMIT 30) AS e ORDER BY e.id DESC",
-					user.Id, user.Id, latestEntryId,
-				)
-			} else {
-				rows, err = dbConn.Query(
-					"SELECT * FROM entries WHERE (user=? OR publish_level=2 OR (publish_level=1 AND user IN (SELECT target FROM follow_map WHERE user=?))) ORDER BY id DESC LIMIT 30",
-					user.Id, user.Id,
-				)
-			}
-			if err != nil {
-				serverError(w, err)
-				return
-			}
-			entries := []Entry{}
-			for rows.Next() {
-				entry := Entry{}
-				rows.Scan(&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt)
-				entries = append(entries, entry)
-			}
-			rows.Close()
-			if 0 < len(entries) {
-				res := []Response{}
-				for _, entry := range entries {
-					user := User{}
-					err = dbConn.QueryRow(
-						"SELECT * FROM users WHERE id = ?", entry.User,
-					).Scan(
-						&user.Id, &user.Name, &user.Apikey, &user.Icon,
-					)
-					if err != nil {
-						serverError(w, err)
-						return
-					}
-					res = append(res, Response{
-						"id":            entry.Id,
-						"image":         baseUrl.String() + "/image/" + entry.Image,
-						"publish_level": entry.PublishLevel,
-						"user": Response{
-							"id":   user.Id,
-							"name": user.Name,
-							"icon": baseUrl.String() + "/icon/" + user.Icon,
-						},
-					})
-				}
-				latestEntryId = entries[0].Id
-				entriesMessage <- res
-				return
-			}
-			time.Sleep(time.Second * interval)
+	// older pages are there already, they are returned without waiting
+	before, err := timelineCursor(r)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	if 0 < before {
+		page, err := loadTimeline(baseUrl, user, latestEntryId, before)
+		if err != nil {
+			serverError(w, err)
+			return
 		}
-	}()
+		renderJsonNoCache(w, page.response())
+		return
+	}
 
-	select {
-	case entries := <-entriesMessage:
-		renderJsonNoCache(w, Response{
-			"latest_entry": latestEntryId,
-			"entries":      entries,
-		})
+	page, err := waitTimeline(r.Context(), baseUrl, user, latestEntryId)
+	if r.Context().Err() != nil {
+		// the client went away
 		return
-	case <-timeoutMessage:
-		renderJsonNoCache(w, Response{
-			"latest_entry": latestEntryId,
-			"entries":      []Entry{},
-		})
+	}
+	if err != nil {
+		serverError(w, err)
 		return
 	}
+	renderJsonNoCache(w, page.response())
 }
 
 func iconHandler(w http.ResponseWriter, r *http.Request) {
@@ -607,24 +457,43 @@ func iconHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	icon := vars["icon"]
 
-	if _, err := os.Stat(config.Datadir + "/icon/" + icon + ".png"); os.IsNotExist(err) {
+	orig := "icon/" + icon + ".png"
+	if ok, err := blobs.Exists(orig); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
 		notFound(w)
 		return
 	}
 
+	if wantsResize(r) {
+		serveResized(w, r, "icon", icon, orig)
+		return
+	}
+
 	size := r.FormValue("size")
 	var target string
+	var pixels int
 	switch size {
 	case "m":
-		target = fmt.Sprintf("%s/icon/%s_m.png", config.Datadir, icon)
+		target = "icon/" + icon + "_m.png"
+		pixels = thumbnail.IconM
 	case "l":
-		target = fmt.Sprintf("%s/icon/%s_l.png", config.Datadir, icon)
+		target = "icon/" + icon + "_l.png"
+		pixels = thumbnail.IconL
 	default:
-		target = fmt.Sprintf("%s/icon/%s_s.png", config.Datadir, icon)
+		target = "icon/" + icon + "_s.png"
+		pixels = thumbnail.IconS
 	}
 
 	var data []byte
-	b, err := ioutil.ReadFile(target)
+	b, err := storage.ReadAll(blobs, target)
+	if err == storage.ErrNotFound {
+		// the thumbnail job has not run yet
+		b, err = placeholderIcon(pixels)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Thumbnail", "pending")
+	}
 	if err != nil {
 		serverError(w, err)
 		return
@@ -694,20 +563,29 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	size := r.FormValue("size")
-	if size == "" {
-		size = "l"
+	if wantsResize(r) {
+		serveResized(w, r, "image", image, "image/"+image+".jpg")
+		return
 	}
 
-	var target string
-	if size == "l" {
-		target = fmt.Sprintf("%s/image/%s.jpg", config.Datadir, image)
-	} else {
-		target = fmt.Sprintf("%s/image/%s_%s.jpg", config.Datadir, image, size)
+	orig := "image/" + image + ".jpg"
+	target := orig
+	size := r.FormValue("size")
+	switch size {
+	case "s", "m":
+		target = "image/" + image + "_" + size + ".jpg"
+	default:
+		size = "l"
 	}
 
 	var data []byte
-	b, err := ioutil.ReadFile(target)
+	b, err := storage.ReadAll(blobs, target)
+	if err == storage.ErrNotFound && size != "l" {
+		// the thumbnail job has not run yet
+		b, err = storage.ReadAll(blobs, orig)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Thumbnail", "pending")
+	}
 	if err != nil {
 		serverError(w, err)
 		return
@@ -759,6 +637,14 @@ func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
+	_, err = dbConn.Exec("DELETE FROM entry_metadata WHERE entry_id = ?", entry.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if err := releaseBlobs(jobImage, entry.Image); err != nil {
+		log.Printf("can't release image %s: %v", entry.Image, err)
+	}
 
 	renderJson(w, Response{"ok": true})
 }
@@ -887,61 +773,22 @@ func updateIconHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uploadFile, handler, err := r.FormFile("image")
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-	if handler == nil {
-		badRequest(w)
-		return
-	}
-
-	contentType := handler.Header.Get("Content-Type")
-	if !regexp.MustCompile("^image/(jpe?g|png)$").MatchString(contentType) {
-		badRequest(w)
-		return
-	}
-
-	data, err := ioutil.ReadAll(uploadFile)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	f, err := ioutil.TempFile(tmpDir, "isucon")
-	defer os.Remove(f.Name())
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	err = ioutil.WriteFile(f.Name(), data, 0666)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	path, err := cropSquare(f.Name(), "png")
-	defer os.Remove(path)
-	if err != nil {
-		serverError(w, err)
+	_, img, _, uerr := readUpload(w, r, "image", "jpeg", "png")
+	if uerr != nil {
+		renderUploadError(w, uerr)
 		return
 	}
 
-	data, err = ioutil.ReadFile(path)
+	iconId := sha256Hex(uuid.NewUUID())
+	err = thumbnail.Store(blobs, "icon/"+iconId+".png", imaging.CropSquare(img), config.Image)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-
-	iconId := sha256Hex(uuid.NewUUID())
-	err = ioutil.WriteFile(config.Datadir+"/icon/"+iconId+".png", data, 0666)
-	if err != nil {
+	if err := thumbnails.enqueue(jobIcon, iconId+".png"); err != nil {
 		serverError(w, err)
 		return
 	}
-	makeIconThumbnails(config.Datadir+"/icon", iconId+".png")
 
 	_, err = dbConn.Exec(
 		"UPDATE users SET icon = ? WHERE id = ?",
@@ -951,6 +798,9 @@ func updateIconHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
+	if err := releaseBlobs(jobIcon, user.Icon); err != nil {
+		log.Printf("can't release icon %s: %v", user.Icon, err)
+	}
 
 	renderJson(w, Response{"icon": baseUrl.String() + "/icon/" + iconId})
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"./storage"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestImageSizes(t *testing.T) {
+	db := useTimelineDB(t)
+	oldBlobs := blobs
+	t.Cleanup(func() { blobs = oldBlobs })
+	blobs = storage.NewLocal(t.TempDir())
+	db.post(1, 2)
+	db.post(1, 2)
+	for _, key := range []string{"image/img1.jpg", "image/img1_s.jpg", "image/img1_m.jpg", "image/img2.jpg"} {
+		if err := blobs.Put(key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/image/{image}", imageHandler)
+
+	tests := []struct {
+		image   string
+		size    string
+		want    string
+		pending bool
+	}{
+		{"img1", "", "image/img1.jpg", false},
+		{"img1", "l", "image/img1.jpg", false},
+		{"img1", "s", "image/img1_s.jpg", false},
+		{"img1", "m", "image/img1_m.jpg", false},
+		{"img2", "s", "image/img2.jpg", true},
+		// other sizes never make it into the key
+		{"img1", "xl", "image/img1.jpg", false},
+		{"img1", "s/../../../../etc/passwd", "image/img1.jpg", false},
+		{"img1", "/../img2", "image/img1.jpg", false},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/image/"+test.image+"?size="+url.QueryEscape(test.size), nil))
+		if w.Code != http.StatusOK || w.Body.String() != test.want {
+			t.Errorf("%s, size %q: got %d %q, want %q", test.image, test.size, w.Code, w.Body.String(), test.want)
+		}
+		if pending := w.Header().Get("X-Thumbnail") == "pending"; pending != test.pending {
+			t.Errorf("%s, size %q: pending %v", test.image, test.size, pending)
+		}
+	}
+}
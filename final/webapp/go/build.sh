@@ -5,5 +5,8 @@ cd $(dirname $0)
 GOPATH=/home/isucon/local/go
 go get github.com/go-sql-driver/mysql
 go get github.com/gorilla/mux
+go get github.com/gorilla/websocket
 go get code.google.com/p/go-uuid/uuid
+go get golang.org/x/image/draw
+go generate
 go build -o app
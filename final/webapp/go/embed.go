@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:generate ./gen_assets.sh
+
+//go:embed embedded/public
+var embedded embed.FS
+
+func embeddedPublic() fs.FS {
+	public, err := fs.Sub(embedded, "embedded/public")
+	if err != nil {
+		panic(err)
+	}
+	return public
+}
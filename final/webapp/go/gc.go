@@ -0,0 +1,195 @@
+package main
+
+import (
+	"./storage"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	defaultGCGrace = 10 * time.Minute
+
+	// defaultIcon is what users.icon of new users says, so it is kept even
+	// when nobody uses it
+	defaultIcon = "default"
+)
+
+type GCConfig struct {
+	// Interval between collections in seconds, 0 turns the collector off
+	Interval int `json:"interval"`
+	// DryRun only reports what would be deleted
+	DryRun bool `json:"dry_run"`
+	// Grace in seconds protects the blobs put more recently: those of an
+	// upload are stored before its entry or user row is written
+	Grace int `json:"grace"`
+}
+
+func (c GCConfig) grace() time.Duration {
+	if c.Grace <= 0 {
+		return defaultGCGrace
+	}
+	return time.Duration(c.Grace) * time.Second
+}
+
+var blobName = regexp.MustCompile(`^([0-9A-Za-z]+)(?:_(?:s|m|l))?\.(?:jpg|png)$`)
+
+func imageKeys(image string) []string {
+	return []string{"image/" + image + ".jpg", "image/" + image + "_s.jpg", "image/" + image + "_m.jpg"}
+}
+
+func iconKeys(icon string) []string {
+	return []string{"icon/" + icon + ".png", "icon/" + icon + "_s.png", "icon/" + icon + "_m.png", "icon/" + icon + "_l.png"}
+}
+
+// releaseBlobs deletes an image or icon with its thumbnails and resized
+// variants once no entry or user refers to it. Failures to delete are only
+// logged, the collector finds what is left.
+func releaseBlobs(kind string, id string) error {
+	query := "SELECT COUNT(*) FROM entries WHERE image = ?"
+	keys := imageKeys(id)
+	if kind == jobIcon {
+		if id == defaultIcon {
+			return nil
+		}
+		query = "SELECT COUNT(*) FROM users WHERE icon = ?"
+		keys = iconKeys(id)
+	}
+	var n int
+	if err := dbConn.QueryRow(query, id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	for _, key := range keys {
+		if err := blobs.Delete(key); err != nil {
+			log.Printf("can't delete %s: %v", key, err)
+		}
+	}
+	removeResized(kind, id)
+	return nil
+}
+
+// gcReport lists the blobs no entry or user refers to, and the originals
+// of entries and users that are not in the store.
+type gcReport struct {
+	Orphaned []string
+	Missing  []string
+	Deleted  int
+}
+
+func (r *gcReport) print(w io.Writer) {
+	for _, key := range r.Orphaned {
+		fmt.Fprintf(w, "orphaned %s\n", key)
+	}
+	for _, key := range r.Missing {
+		fmt.Fprintf(w, "missing %s\n", key)
+	}
+	fmt.Fprintf(w, "%d orphaned, %d missing, %d deleted\n", len(r.Orphaned), len(r.Missing), r.Deleted)
+}
+
+// collectGarbage reconciles the store with entries.image and users.icon.
+// The store is listed before the tables are read, so a blob whose row is
+// written in between is not taken for an orphan. Blobs younger than grace
+// are left alone, their rows may not have been written yet.
+func collectGarbage(store storage.BlobStore, dryRun bool, grace time.Duration) (*gcReport, error) {
+	stored := map[string]bool{}
+	recent := map[string]bool{}
+	for _, prefix := range []string{"image/", "icon/"} {
+		blobs, err := store.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blobs {
+			stored[b.Key] = true
+			if time.Since(b.Modified) < grace {
+				recent[b.Key] = true
+			}
+		}
+	}
+
+	live := map[string]bool{jobIcon + "/" + defaultIcon: true}
+	report := &gcReport{}
+	for _, q := range []struct{ kind, query string }{
+		{jobImage, "SELECT DISTINCT image FROM entries"},
+		{jobIcon, "SELECT DISTINCT icon FROM users"},
+	} {
+		ids, err := queryStrings(q.query)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			live[q.kind+"/"+id] = true
+			orig := imageKeys(id)[0]
+			if q.kind == jobIcon {
+				orig = iconKeys(id)[0]
+			}
+			if !stored[orig] {
+				report.Missing = append(report.Missing, orig)
+			}
+		}
+	}
+
+	for key := range stored {
+		m := blobName.FindStringSubmatch(path.Base(key))
+		if recent[key] || m != nil && live[path.Dir(key)+"/"+m[1]] {
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, key)
+		if dryRun {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			log.Printf("gc: can't delete %s: %v", key, err)
+			continue
+		}
+		report.Deleted++
+		if m != nil {
+			removeResized(path.Dir(key), m[1])
+		}
+	}
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+func queryStrings(query string) ([]string, error) {
+	rows, err := dbConn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// runGC collects garbage every interval and logs what it found.
+func runGC(c GCConfig) {
+	for {
+		time.Sleep(time.Duration(c.Interval) * time.Second)
+		report, err := collectGarbage(blobs, c.DryRun, c.grace())
+		if err != nil {
+			log.Printf("gc: %v", err)
+			continue
+		}
+		for _, key := range report.Orphaned {
+			log.Printf("gc: orphaned %s", key)
+		}
+		for _, key := range report.Missing {
+			log.Printf("gc: missing %s", key)
+		}
+		log.Printf("gc: %d orphaned, %d missing, %d deleted", len(report.Orphaned), len(report.Missing), report.Deleted)
+	}
+}
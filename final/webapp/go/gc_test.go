@@ -0,0 +1,242 @@
+package main
+
+import (
+	"./storage"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// gcDB is entries.image and users.icon, one value per row.
+type gcDB struct {
+	images []string
+	icons  []string
+}
+
+var testGCDB *gcDB
+
+// useGCDB points dbConn at db and blobs at a directory that is removed
+// after the test, which is also the data directory of the resize cache.
+func useGCDB(t *testing.T, db *gcDB) (*storage.Local, string) {
+	oldConfig, oldConn, oldBlobs := config, dbConn, blobs
+	t.Cleanup(func() { config, dbConn, blobs = oldConfig, oldConn, oldBlobs })
+	dir := t.TempDir()
+	config = &Config{Datadir: dir}
+	store := storage.NewLocal(dir)
+	blobs = store
+	testGCDB = db
+	var err error
+	if dbConn, err = sql.Open("gctest", ""); err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+// putOld puts blobs that were last written an hour ago.
+func putOld(t *testing.T, store storage.BlobStore, dir string, keys ...string) {
+	old := time.Now().Add(-time.Hour)
+	for _, key := range keys {
+		if err := store.Put(key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, key), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// putResized adds a cached variant of the image or icon id.
+func putResized(t *testing.T, dir string, kind string, id string) string {
+	path := filepath.Join(dir, "cache", kind, id+"_64x64_crop@1x.jpg")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func storedKeys(t *testing.T, store storage.BlobStore) []string {
+	keys := []string{}
+	for _, prefix := range []string{"icon/", "image/"} {
+		blobs, err := store.List(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blobs {
+			keys = append(keys, b.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type gcConn struct{}
+type gcStmt struct{ query string }
+
+func (gcConn) Prepare(query string) (driver.Stmt, error) { return gcStmt{query}, nil }
+func (gcConn) Close() error                              { return nil }
+func (gcConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s gcStmt) Close() error  { return nil }
+func (s gcStmt) NumInput() int { return -1 }
+
+func (s gcStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("unexpected exec %q", s.query)
+}
+
+func (s gcStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := testGCDB
+	distinct := func(column string, values []string) driver.Rows {
+		rows := &timelineRows{columns: []string{column}}
+		seen := map[string]bool{}
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				rows.values = append(rows.values, []driver.Value{v})
+			}
+		}
+		return rows
+	}
+	count := func(values []string) driver.Rows {
+		n := int64(0)
+		for _, v := range values {
+			if v == args[0].(string) {
+				n++
+			}
+		}
+		return &timelineRows{[]string{"COUNT(*)"}, [][]driver.Value{{n}}}
+	}
+	switch s.query {
+	case "SELECT DISTINCT image FROM entries":
+		return distinct("image", db.images), nil
+	case "SELECT DISTINCT icon FROM users":
+		return distinct("icon", db.icons), nil
+	case "SELECT COUNT(*) FROM entries WHERE image = ?":
+		return count(db.images), nil
+	case "SELECT COUNT(*) FROM users WHERE icon = ?":
+		return count(db.icons), nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+type gcDriver struct{}
+
+func (gcDriver) Open(name string) (driver.Conn, error) { return gcConn{}, nil }
+
+func init() {
+	sql.Register("gctest", gcDriver{})
+}
+
+func TestCollectGarbage(t *testing.T) {
+	store, dir := useGCDB(t, &gcDB{
+		images: []string{"aa", "aa", "ff"},
+		icons:  []string{"dd", "gg"},
+	})
+	live := []string{
+		"icon/dd.png", "icon/dd_l.png",
+		// nobody uses it but new users get it
+		"icon/default.png", "icon/default_s.png",
+		"image/aa.jpg", "image/aa_m.jpg", "image/aa_s.jpg",
+	}
+	orphaned := []string{
+		"icon/default2.png",
+		"icon/ee_m.png",
+		"image/bb.jpg", "image/bb_s.jpg",
+		"image/junk.txt",
+	}
+	putOld(t, store, dir, live...)
+	putOld(t, store, dir, orphaned...)
+	// too new to tell, its entry may be being written
+	if err := store.Put("image/cc.jpg", []byte("cc"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	kept := putResized(t, dir, "image", "aa")
+	dropped := putResized(t, dir, "image", "bb")
+	all := storedKeys(t, store)
+
+	report, err := collectGarbage(store, true, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &gcReport{Orphaned: orphaned, Missing: []string{"icon/gg.png", "image/ff.jpg"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("dry run reported %+v, want %+v", report, want)
+	}
+	if keys := storedKeys(t, store); !reflect.DeepEqual(keys, all) {
+		t.Errorf("dry run left %v, want %v", keys, all)
+	}
+	if !FileExists(dropped) {
+		t.Error("dry run deleted a resized variant")
+	}
+	var out bytes.Buffer
+	report.print(&out)
+	if last := "5 orphaned, 2 missing, 0 deleted\n"; !bytes.HasSuffix(out.Bytes(), []byte(last)) {
+		t.Errorf("printed %q, want it to end in %q", out.String(), last)
+	}
+
+	report, err = collectGarbage(store, false, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Deleted = len(orphaned); !reflect.DeepEqual(report, want) {
+		t.Errorf("collection reported %+v, want %+v", report, want)
+	}
+	left := append([]string{"image/cc.jpg"}, live...)
+	sort.Strings(left)
+	if keys := storedKeys(t, store); !reflect.DeepEqual(keys, left) {
+		t.Errorf("collection left %v, want %v", keys, left)
+	}
+	if FileExists(dropped) || !FileExists(kept) {
+		t.Error("the resized variants of the wrong images were deleted")
+	}
+
+	// once the grace is over the new blob goes too
+	report, err = collectGarbage(store, false, 0)
+	if err != nil || !reflect.DeepEqual(report.Orphaned, []string{"image/cc.jpg"}) {
+		t.Errorf("collection without grace reported %+v, %v", report, err)
+	}
+}
+
+func TestReleaseBlobs(t *testing.T) {
+	tests := []struct {
+		kind     string
+		id       string
+		released bool
+	}{
+		{jobImage, "aa", false},
+		{jobImage, "bb", true},
+		{jobIcon, "dd", false},
+		{jobIcon, "ee", true},
+		// nobody uses it but new users get it
+		{jobIcon, defaultIcon, false},
+	}
+	for _, test := range tests {
+		store, dir := useGCDB(t, &gcDB{images: []string{"aa"}, icons: []string{"dd", "dd"}})
+		keys := imageKeys(test.id)
+		if test.kind == jobIcon {
+			keys = iconKeys(test.id)
+		}
+		putOld(t, store, dir, keys...)
+		resized := putResized(t, dir, test.kind, test.id)
+
+		if err := releaseBlobs(test.kind, test.id); err != nil {
+			t.Fatalf("%s %s: %v", test.kind, test.id, err)
+		}
+		left := storedKeys(t, store)
+		if test.released && (len(left) != 0 || FileExists(resized)) {
+			t.Errorf("%s %s: %v left, resized variant left: %v", test.kind, test.id, left, FileExists(resized))
+		}
+		if !test.released && (len(left) != len(keys) || !FileExists(resized)) {
+			t.Errorf("%s %s: only %v left", test.kind, test.id, left)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"strings"
+)
+
+var ErrExif = errors.New("imaging: malformed EXIF data")
+
+// Metadata is the part of the EXIF data of a photo its owner may want
+// back: the camera, the exposure and where it was taken.
+type Metadata struct {
+	Make             string   `json:"make,omitempty"`
+	Model            string   `json:"model,omitempty"`
+	LensModel        string   `json:"lens_model,omitempty"`
+	Software         string   `json:"software,omitempty"`
+	DateTime         string   `json:"date_time,omitempty"`
+	DateTimeOriginal string   `json:"date_time_original,omitempty"`
+	ExposureTime     string   `json:"exposure_time,omitempty"`
+	FNumber          float64  `json:"f_number,omitempty"`
+	ISO              int      `json:"iso,omitempty"`
+	FocalLength      float64  `json:"focal_length,omitempty"`
+	Latitude         *float64 `json:"latitude,omitempty"`
+	Longitude        *float64 `json:"longitude,omitempty"`
+	Orientation      int      `json:"orientation,omitempty"`
+}
+
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+
+	tagGPSLatitudeRef  = 1
+	tagGPSLatitude     = 2
+	tagGPSLongitudeRef = 3
+	tagGPSLongitude    = 4
+)
+
+const (
+	markerSOI  = 0xd8
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerAPPE = 0xee
+	markerCOM  = 0xfe
+)
+
+type jpegSegment struct {
+	marker byte
+	start  int
+	end    int
+}
+
+// jpegSegments lists the segments of a JPEG up to the start of the scan,
+// whose offset is returned too.
+func jpegSegments(data []byte) ([]jpegSegment, int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, 0, ErrFormat
+	}
+	segments := []jpegSegment{}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil, 0, ErrFormat
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == markerSOS {
+			return segments, i, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, 0, ErrFormat
+		}
+		segments = append(segments, jpegSegment{marker, i, i + 2 + length})
+		i += 2 + length
+	}
+	return nil, 0, ErrFormat
+}
+
+// exifPayload is the TIFF structure in the Exif APP1 segment of a JPEG,
+// or nil if there is none.
+func exifPayload(data []byte) []byte {
+	segments, _, err := jpegSegments(data)
+	if err != nil {
+		return nil
+	}
+	for _, s := range segments {
+		body := data[s.start+4 : s.end]
+		if s.marker == markerAPP1 && bytes.HasPrefix(body, []byte("Exif\x00\x00")) {
+			return body[6:]
+		}
+	}
+	return nil
+}
+
+// ReadExif reads the metadata of a JPEG. It returns nil without an error
+// when there is no EXIF data.
+func ReadExif(data []byte) (*Metadata, error) {
+	tiff := exifPayload(data)
+	if tiff == nil {
+		return nil, nil
+	}
+	if len(tiff) < 8 {
+		return nil, ErrExif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, ErrExif
+	}
+	p := &tiffParser{data: tiff, order: order}
+	m := &Metadata{}
+	ifd0, err := p.ifd(order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+	m.Make = p.ascii(ifd0[tagMake])
+	m.Model = p.ascii(ifd0[tagModel])
+	m.Software = p.ascii(ifd0[tagSoftware])
+	m.DateTime = p.ascii(ifd0[tagDateTime])
+	m.Orientation = p.int(ifd0[tagOrientation])
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if exif, err := p.ifd(uint32(p.int(e))); err == nil {
+			m.DateTimeOriginal = p.ascii(exif[tagDateTimeOriginal])
+			m.LensModel = p.ascii(exif[tagLensModel])
+			m.ISO = p.int(exif[tagISO])
+			m.FNumber = p.rational(exif[tagFNumber], 0)
+			m.FocalLength = p.rational(exif[tagFocalLength], 0)
+			if e, ok := exif[tagExposureTime]; ok && e.count > 0 {
+				num, den := p.fraction(e, 0)
+				m.ExposureTime = fmt.Sprintf("%d/%d", num, den)
+			}
+		}
+	}
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if gps, err := p.ifd(uint32(p.int(e))); err == nil {
+			m.Latitude = p.coordinate(gps[tagGPSLatitude], p.ascii(gps[tagGPSLatitudeRef]), "S")
+			m.Longitude = p.coordinate(gps[tagGPSLongitude], p.ascii(gps[tagGPSLongitudeRef]), "W")
+		}
+	}
+	return m, nil
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffParser struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (p *tiffParser) ifd(offset uint32) (map[uint16]*ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(p.data)) {
+		return nil, ErrExif
+	}
+	n := int(p.order.Uint16(p.data[offset:]))
+	start := int(offset) + 2
+	if start+n*12 > len(p.data) {
+		return nil, ErrExif
+	}
+	entries := make(map[uint16]*ifdEntry, n)
+	for i := 0; i < n; i++ {
+		b := p.data[start+i*12:]
+		e := &ifdEntry{typ: p.order.Uint16(b[2:]), count: p.order.Uint32(b[4:])}
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(e.count)
+		if total <= 4 {
+			e.value = b[8 : 8+total]
+		} else {
+			off := uint64(p.order.Uint32(b[8:]))
+			if off+total > uint64(len(p.data)) {
+				continue
+			}
+			e.value = p.data[off : off+total]
+		}
+		entries[p.order.Uint16(b)] = e
+	}
+	return entries, nil
+}
+
+func (p *tiffParser) ascii(e *ifdEntry) string {
+	if e == nil || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (p *tiffParser) int(e *ifdEntry) int {
+	if e == nil || e.count == 0 {
+		return 0
+	}
+	switch e.typ {
+	case 3:
+		return int(p.order.Uint16(e.value))
+	case 4, 9:
+		return int(p.order.Uint32(e.value))
+	}
+	return 0
+}
+
+func (p *tiffParser) fraction(e *ifdEntry, i int) (uint32, uint32) {
+	if e == nil || (e.typ != 5 && e.typ != 10) || uint32(i) >= e.count {
+		return 0, 0
+	}
+	return p.order.Uint32(e.value[i*8:]), p.order.Uint32(e.value[i*8+4:])
+}
+
+func (p *tiffParser) rational(e *ifdEntry, i int) float64 {
+	num, den := p.fraction(e, i)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// coordinate turns degrees, minutes and seconds into signed degrees.
+func (p *tiffParser) coordinate(e *ifdEntry, ref string, negative string) *float64 {
+	if e == nil || e.count < 3 {
+		return nil
+	}
+	v := p.rational(e, 0) + p.rational(e, 1)/60 + p.rational(e, 2)/3600
+	if ref == negative {
+		v = -v
+	}
+	return &v
+}
+
+// StripMetadata drops the EXIF, XMP, IPTC and comment segments of a JPEG
+// without decoding it. The JFIF header, the ICC profile and the Adobe
+// segment stay, as they change how the image is decoded.
+func StripMetadata(data []byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	for _, s := range segments {
+		if !isMetadata(s.marker) {
+			out = append(out, data[s.start:s.end]...)
+		}
+	}
+	return append(out, data[scan:]...), nil
+}
+
+func isMetadata(marker byte) bool {
+	switch marker {
+	case markerAPP0, markerAPP2, markerAPPE:
+		return false
+	case markerCOM:
+		return true
+	}
+	return marker > markerAPP0 && marker <= 0xef
+}
+
+// Orient turns img upright according to an EXIF orientation from 1 to 8.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,405 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// tiffWriter lays out TIFF structures in one byte order. Each IFD is
+// followed by the values that do not fit in its entries.
+type tiffWriter struct {
+	order binary.ByteOrder
+	buf   []byte
+}
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+	// offset, if set, is written instead of where value ends up
+	offset *uint32
+}
+
+func newTiffWriter(order binary.ByteOrder) *tiffWriter {
+	w := &tiffWriter{order: order}
+	if order == binary.LittleEndian {
+		w.buf = []byte("II*\x00\x00\x00\x00\x00")
+	} else {
+		w.buf = []byte("MM\x00*\x00\x00\x00\x00")
+	}
+	return w
+}
+
+func (w *tiffWriter) put16(v uint16) { w.buf = append(w.buf, w.uint16(v)...) }
+func (w *tiffWriter) put32(v uint32) { w.buf = append(w.buf, w.uint32(v)...) }
+
+func (w *tiffWriter) uint16(v uint16) []byte {
+	b := make([]byte, 2)
+	w.order.PutUint16(b, v)
+	return b
+}
+
+func (w *tiffWriter) uint32(v uint32) []byte {
+	b := make([]byte, 4)
+	w.order.PutUint32(b, v)
+	return b
+}
+
+// ifd appends an IFD and returns its offset.
+func (w *tiffWriter) ifd(fields ...tiffField) uint32 {
+	off := uint32(len(w.buf))
+	extra := []byte{}
+	values := off + 2 + 12*uint32(len(fields)) + 4
+	w.put16(uint16(len(fields)))
+	for _, f := range fields {
+		w.put16(f.tag)
+		w.put16(f.typ)
+		w.put32(f.count)
+		switch {
+		case f.offset != nil:
+			w.put32(*f.offset)
+		case len(f.value) <= 4:
+			w.buf = append(w.buf, f.value...)
+			w.buf = append(w.buf, make([]byte, 4-len(f.value))...)
+		default:
+			w.put32(values + uint32(len(extra)))
+			extra = append(extra, f.value...)
+		}
+	}
+	w.put32(0)
+	w.buf = append(w.buf, extra...)
+	return off
+}
+
+// bytes returns the TIFF with its first IFD at ifd0.
+func (w *tiffWriter) bytes(ifd0 uint32) []byte {
+	w.order.PutUint32(w.buf[4:], ifd0)
+	return w.buf
+}
+
+func (w *tiffWriter) ascii(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func (w *tiffWriter) short(tag uint16, v uint16) tiffField {
+	return tiffField{tag: tag, typ: 3, count: 1, value: w.uint16(v)}
+}
+
+func (w *tiffWriter) long(tag uint16, v uint32) tiffField {
+	return tiffField{tag: tag, typ: 4, count: 1, value: w.uint32(v)}
+}
+
+// rationals takes numerator and denominator pairs.
+func (w *tiffWriter) rationals(tag uint16, v ...uint32) tiffField {
+	f := tiffField{tag: tag, typ: 5, count: uint32(len(v) / 2)}
+	for _, x := range v {
+		f.value = append(f.value, w.uint32(x)...)
+	}
+	return f
+}
+
+func at(off uint32) *uint32 { return &off }
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), "jpeg", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type jpegSegmentData struct {
+	marker byte
+	body   []byte
+}
+
+// withSegments inserts segments right after the SOI marker of jpg.
+func withSegments(jpg []byte, segments ...jpegSegmentData) []byte {
+	out := append([]byte{}, jpg[:2]...)
+	for _, s := range segments {
+		out = append(out, 0xff, s.marker)
+		out = append(out, byte((len(s.body)+2)>>8), byte(len(s.body)+2))
+		out = append(out, s.body...)
+	}
+	return append(out, jpg[2:]...)
+}
+
+func exifSegment(tiff []byte) jpegSegmentData {
+	return jpegSegmentData{markerAPP1, append([]byte("Exif\x00\x00"), tiff...)}
+}
+
+func float(v float64) *float64 { return &v }
+
+func TestReadExif(t *testing.T) {
+	jpg := testJPEG(t, 8, 8)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		w := newTiffWriter(order)
+		exif := w.ifd(
+			w.rationals(tagExposureTime, 1, 125),
+			w.rationals(tagFNumber, 28, 10),
+			w.short(tagISO, 400),
+			w.ascii(tagDateTimeOriginal, "2013:11:09 10:00:00"),
+			w.rationals(tagFocalLength, 50, 1),
+			w.ascii(tagLensModel, "EF50mm f/1.8 II"),
+		)
+		gps := w.ifd(
+			w.ascii(tagGPSLatitudeRef, "S"),
+			w.rationals(tagGPSLatitude, 35, 1, 30, 1, 0, 1),
+			w.ascii(tagGPSLongitudeRef, "E"),
+			w.rationals(tagGPSLongitude, 139, 1, 45, 1, 0, 1),
+		)
+		ifd0 := w.ifd(
+			w.ascii(tagMake, "Canon"),
+			w.ascii(tagModel, "Canon EOS 5D "),
+			w.short(tagOrientation, 6),
+			w.ascii(tagSoftware, "GIMP"),
+			w.ascii(tagDateTime, "2013:11:09 12:00:00"),
+			w.long(tagExifIFD, exif),
+			w.long(tagGPSIFD, gps),
+		)
+		m, err := ReadExif(withSegments(jpg, exifSegment(w.bytes(ifd0))))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		want := &Metadata{
+			Make:             "Canon",
+			Model:            "Canon EOS 5D",
+			LensModel:        "EF50mm f/1.8 II",
+			Software:         "GIMP",
+			DateTime:         "2013:11:09 12:00:00",
+			DateTimeOriginal: "2013:11:09 10:00:00",
+			ExposureTime:     "1/125",
+			FNumber:          2.8,
+			ISO:              400,
+			FocalLength:      50,
+			Latitude:         float(-35.5),
+			Longitude:        float(139.75),
+			Orientation:      6,
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("%v: read %+v, want %+v", order, m, want)
+		}
+	}
+}
+
+func TestReadExifMalformed(t *testing.T) {
+	jpg := testJPEG(t, 8, 8)
+	tests := []struct {
+		name string
+		// tiff builds the payload with w
+		tiff func(w *tiffWriter) []byte
+		want *Metadata
+		err  error
+	}{
+		{"short header", func(w *tiffWriter) []byte { return w.buf[:6] }, nil, ErrExif},
+		{"byte order", func(w *tiffWriter) []byte { return []byte("IM*\x00\x08\x00\x00\x00\x00\x00") }, nil, ErrExif},
+		{"ifd0 past the end", func(w *tiffWriter) []byte { return w.bytes(1000) }, nil, ErrExif},
+		{"ifd0 offset overflows", func(w *tiffWriter) []byte { return w.bytes(0xffffffff) }, nil, ErrExif},
+		{"truncated ifd0", func(w *tiffWriter) []byte {
+			ifd0 := w.ifd(w.short(tagOrientation, 3), w.short(tagISO, 100))
+			return w.bytes(ifd0)[:ifd0+2+12]
+		}, nil, ErrExif},
+		{"entry count past the end", func(w *tiffWriter) []byte {
+			ifd0 := w.ifd(w.short(tagOrientation, 3))
+			w.order.PutUint16(w.buf[ifd0:], 0xffff)
+			return w.bytes(ifd0)
+		}, nil, ErrExif},
+		{"value offset past the end", func(w *tiffWriter) []byte {
+			f := w.ascii(tagMake, "Nikon Corporation")
+			f.offset = at(5000)
+			return w.bytes(w.ifd(f, w.short(tagOrientation, 3)))
+		}, &Metadata{Orientation: 3}, nil},
+		{"value offset overflows", func(w *tiffWriter) []byte {
+			f := w.ascii(tagMake, "Nikon Corporation")
+			f.offset = at(0xfffffff0)
+			return w.bytes(w.ifd(f, w.short(tagOrientation, 3)))
+		}, &Metadata{Orientation: 3}, nil},
+		{"count past the end", func(w *tiffWriter) []byte {
+			f := w.rationals(tagGPSLatitude, 35, 1, 30, 1, 0, 1)
+			f.count = 0xffffffff
+			gps := w.ifd(f)
+			return w.bytes(w.ifd(w.long(tagGPSIFD, gps)))
+		}, &Metadata{}, nil},
+		{"too few coordinates", func(w *tiffWriter) []byte {
+			gps := w.ifd(w.rationals(tagGPSLatitude, 35, 1, 30, 1))
+			return w.bytes(w.ifd(w.long(tagGPSIFD, gps)))
+		}, &Metadata{}, nil},
+		{"zero denominators", func(w *tiffWriter) []byte {
+			exif := w.ifd(w.rationals(tagFNumber, 28, 0), w.rationals(tagFocalLength, 50, 0))
+			return w.bytes(w.ifd(w.long(tagExifIFD, exif)))
+		}, &Metadata{}, nil},
+		{"empty rational", func(w *tiffWriter) []byte {
+			f := w.rationals(tagExposureTime)
+			exif := w.ifd(f, w.short(tagISO, 100))
+			return w.bytes(w.ifd(w.long(tagExifIFD, exif)))
+		}, &Metadata{ISO: 100}, nil},
+		{"wrong types", func(w *tiffWriter) []byte {
+			return w.bytes(w.ifd(
+				tiffField{tag: tagMake, typ: 3, count: 1, value: []byte{1, 0}},
+				tiffField{tag: tagOrientation, typ: 2, count: 2, value: []byte("6\x00")},
+				tiffField{tag: tagModel, typ: 99, count: 4, value: []byte("EOS\x00")},
+			))
+		}, &Metadata{}, nil},
+		{"sub ifds out of range", func(w *tiffWriter) []byte {
+			return w.bytes(w.ifd(w.long(tagExifIFD, 0xfffffffe), w.long(tagGPSIFD, 9999), w.short(tagOrientation, 8)))
+		}, &Metadata{Orientation: 8}, nil},
+		// the sub IFDs point back at IFD0 and at themselves
+		{"looping ifds", func(w *tiffWriter) []byte {
+			ifd0 := uint32(len(w.buf))
+			gps := ifd0 + 2 + 3*12 + 4
+			w.ifd(w.ascii(tagMake, "Ab"), w.long(tagExifIFD, ifd0), w.long(tagGPSIFD, gps))
+			w.ifd(w.long(tagGPSIFD, gps))
+			return w.bytes(ifd0)
+		}, &Metadata{Make: "Ab"}, nil},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, test := range tests {
+			m, err := ReadExif(withSegments(jpg, exifSegment(test.tiff(newTiffWriter(order)))))
+			if err != test.err || !reflect.DeepEqual(m, test.want) {
+				t.Errorf("%v, %s: read %+v, %v, want %+v, %v", order, test.name, m, err, test.want, test.err)
+			}
+		}
+	}
+}
+
+func TestReadExifWithout(t *testing.T) {
+	jpg := testJPEG(t, 8, 8)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain jpeg", jpg},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n")},
+		{"truncated segment", withSegments(jpg, exifSegment(newTiffWriter(binary.BigEndian).bytes(8)))[:20]},
+		{"xmp in app1", withSegments(jpg, jpegSegmentData{markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x/>")})},
+	}
+	for _, test := range tests {
+		if m, err := ReadExif(test.data); m != nil || err != nil {
+			t.Errorf("%s: read %+v, %v", test.name, m, err)
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	jpg := testJPEG(t, 8, 8)
+	w := newTiffWriter(binary.BigEndian)
+	tiff := w.bytes(w.ifd(w.ascii(tagMake, "Canon"), w.short(tagOrientation, 6)))
+	tests := []struct {
+		segment jpegSegmentData
+		keep    bool
+	}{
+		{jpegSegmentData{markerAPP0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")}, true},
+		{exifSegment(tiff), false},
+		{jpegSegmentData{markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")}, false},
+		{jpegSegmentData{markerAPP2, []byte("ICC_PROFILE\x00\x01\x01")}, true},
+		{jpegSegmentData{0xed, []byte("Photoshop 3.0\x00")}, false},
+		{jpegSegmentData{markerAPPE, []byte("Adobe\x00\x64\x00\x00\x00\x00\x01")}, true},
+		{jpegSegmentData{markerCOM, []byte("a comment")}, false},
+		{jpegSegmentData{0xef, []byte("vendor")}, false},
+	}
+	var all, kept []jpegSegmentData
+	for _, test := range tests {
+		all = append(all, test.segment)
+		if test.keep {
+			kept = append(kept, test.segment)
+		}
+	}
+	data := withSegments(jpg, all...)
+	if m, err := ReadExif(data); err != nil || m == nil || m.Make != "Canon" {
+		t.Fatalf("before stripping: %+v, %v", m, err)
+	}
+
+	stripped, err := StripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ReadExif(stripped); m != nil || err != nil {
+		t.Errorf("after stripping: %+v, %v", m, err)
+	}
+	if !bytes.Equal(stripped, withSegments(jpg, kept...)) {
+		for _, test := range tests {
+			if bytes.Contains(stripped, test.segment.body) != test.keep {
+				t.Errorf("segment %#x %q: kept is not %v", test.segment.marker, test.segment.body, test.keep)
+			}
+		}
+		t.Error("stripped jpeg is not the original without the metadata segments")
+	}
+	if _, _, err := Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("decoding the stripped jpeg: %v", err)
+	}
+	again, err := StripMetadata(stripped)
+	if err != nil || !bytes.Equal(again, stripped) {
+		t.Errorf("stripping twice changed it: %v", err)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("GIF89a"), jpg[:100], data[:30]} {
+		if _, err := StripMetadata(bad); err != ErrFormat {
+			t.Errorf("stripping %d bytes: %v, want ErrFormat", len(bad), err)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a 3 x 2 image with the pixels of the top row marked
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	first := color.RGBA{255, 0, 0, 255}
+	second := color.RGBA{0, 255, 0, 255}
+	src.Set(0, 0, first)
+	src.Set(1, 0, second)
+	tests := []struct {
+		orientation   int
+		w, h          int
+		first, second image.Point
+	}{
+		{0, 3, 2, image.Pt(0, 0), image.Pt(1, 0)},
+		{1, 3, 2, image.Pt(0, 0), image.Pt(1, 0)},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(1, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(1, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(1, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 1)},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 1)},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 1)},
+		{9, 3, 2, image.Pt(0, 0), image.Pt(1, 0)},
+	}
+	for _, test := range tests {
+		img := Orient(src, test.orientation)
+		if b := img.Bounds(); b != image.Rect(0, 0, test.w, test.h) {
+			t.Errorf("orientation %d: bounds %v, want %dx%d", test.orientation, b, test.w, test.h)
+			continue
+		}
+		if img.At(test.first.X, test.first.Y) != first || img.At(test.second.X, test.second.Y) != second {
+			t.Errorf("orientation %d: top row is not at %v and %v", test.orientation, test.first, test.second)
+		}
+	}
+
+	// an image that does not start at 0, 0 is copied first
+	sub := src.SubImage(image.Rect(1, 0, 3, 2))
+	if img := Orient(sub, 6); img.Bounds() != image.Rect(0, 0, 2, 2) || img.At(1, 0) != second {
+		t.Errorf("orienting a sub image: %v", img.Bounds())
+	}
+}
+
+func TestDecodeOrients(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+	for orientation := 1; orientation <= 8; orientation++ {
+		w := newTiffWriter(binary.LittleEndian)
+		data := withSegments(jpg, exifSegment(w.bytes(w.ifd(w.short(tagOrientation, uint16(orientation))))))
+		img, _, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+		want := image.Rect(0, 0, 40, 20)
+		if orientation >= 5 {
+			want = image.Rect(0, 0, 20, 40)
+		}
+		if img.Bounds() != want {
+			t.Errorf("orientation %d: decoded %v, want %v", orientation, img.Bounds(), want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package imaging decodes, crops, resizes and encodes the images the app
+// stores, in process instead of running ImageMagick for every upload.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultQuality = 70
+
+var ErrFormat = errors.New("imaging: unsupported format")
+
+type Options struct {
+	// Quality is the JPEG quality from 1 to 100, DefaultQuality if 0.
+	Quality int `json:"quality"`
+}
+
+func (o Options) quality() int {
+	if o.Quality < 1 || o.Quality > 100 {
+		return DefaultQuality
+	}
+	return o.Quality
+}
+
+// Decode reads a JPEG, PNG or GIF image and returns its format name too.
+// A JPEG is turned upright according to its EXIF orientation.
+func Decode(r io.Reader) (image.Image, string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, "", ErrFormat
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "jpeg" {
+		if m, _ := ReadExif(data); m != nil {
+			img = Orient(img, m.Orientation)
+		}
+	}
+	return img, format, nil
+}
+
+func DecodeFile(path string) (image.Image, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	return Decode(f)
+}
+
+// CropSquare cuts the largest square out of the centre of img.
+func CropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	size := b.Dx()
+	if b.Dy() < size {
+		size = b.Dy()
+	}
+	return cropCenter(img, size, size)
+}
+
+func cropCenter(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	min := b.Min.Add(image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2))
+	r := image.Rectangle{min, min.Add(image.Pt(w, h))}
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// Fill scales img to cover w x h and cuts off what sticks out on both
+// sides, so the result is exactly w x h.
+func Fill(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 || w < 1 || h < 1 {
+		return img
+	}
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	if cw < 1 {
+		cw = 1
+	}
+	if ch < 1 {
+		ch = 1
+	}
+	return Resize(cropCenter(img, cw, ch), w, h)
+}
+
+// Fit scales img up or down to the largest size within w x h that keeps
+// its aspect ratio, like ImageMagick's -geometry WxH.
+func Fit(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return img
+	}
+	dw, dh := w, b.Dy()*w/b.Dx()
+	if dh > h {
+		dw, dh = b.Dx()*h/b.Dy(), h
+	}
+	return Resize(img, dw, dh)
+}
+
+// Resize scales img to exactly w x h with the Catmull-Rom filter.
+func Resize(img image.Image, w, h int) image.Image {
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	b := img.Bounds()
+	if b.Dx() == w && b.Dy() == h {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// Encode writes img as format, which is "jpeg", "png" or "gif".
+func Encode(w io.Writer, img image.Image, format string, o Options) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: o.quality()})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return ErrFormat
+}
+
+// FormatOf is the format EncodeFile uses for path, by its extension.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	case ".gif":
+		return "gif"
+	}
+	return ""
+}
+
+// EncodeFile writes img to path in the format its extension names. The
+// file is written under a temporary name first, so readers never see a
+// partial image.
+func EncodeFile(path string, img image.Image, o Options) error {
+	format := FormatOf(path)
+	if format == "" {
+		return ErrFormat
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".imaging")
+	if err != nil {
+		return err
+	}
+	if err = Encode(f, img, format, o); err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// plainImage hides the SubImage method of the image it wraps.
+type plainImage struct {
+	image.Image
+}
+
+func TestCropSquare(t *testing.T) {
+	tests := []struct {
+		bounds image.Rectangle
+		want   image.Rectangle
+	}{
+		{image.Rect(0, 0, 400, 200), image.Rect(100, 0, 300, 200)},
+		{image.Rect(0, 0, 200, 400), image.Rect(0, 100, 200, 300)},
+		{image.Rect(0, 0, 101, 100), image.Rect(0, 0, 100, 100)},
+		{image.Rect(0, 0, 64, 64), image.Rect(0, 0, 64, 64)},
+		{image.Rect(0, 0, 1, 300), image.Rect(0, 149, 1, 150)},
+		{image.Rect(10, 10, 50, 30), image.Rect(20, 10, 40, 30)},
+	}
+	for _, test := range tests {
+		img := image.NewRGBA(test.bounds)
+		center := test.want.Min.Add(test.want.Size().Div(2))
+		img.Set(center.X, center.Y, color.RGBA{255, 0, 0, 255})
+		if got := CropSquare(img).Bounds(); got != test.want {
+			t.Errorf("%v: cropped to %v, want %v", test.bounds, got, test.want)
+		}
+
+		// without SubImage the square is copied
+		copied := CropSquare(plainImage{img})
+		if got := copied.Bounds(); got != image.Rect(0, 0, test.want.Dx(), test.want.Dy()) {
+			t.Errorf("%v: copied %v, want %v", test.bounds, got, test.want.Size())
+			continue
+		}
+		if c := copied.At(center.X-test.want.Min.X, center.Y-test.want.Min.Y); c != (color.RGBA{255, 0, 0, 255}) {
+			t.Errorf("%v: the copy is off centre", test.bounds)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h       int
+		maxW, maxH int
+		dw, dh     int
+	}{
+		{400, 200, 128, 128, 128, 64},
+		{200, 400, 128, 128, 64, 128},
+		{640, 480, 256, 256, 256, 192},
+		{100, 100, 256, 256, 256, 256},
+		{32, 16, 128, 128, 128, 64},
+		{128, 128, 128, 128, 128, 128},
+		{300, 100, 60, 10, 30, 10},
+		{1000, 1, 128, 128, 128, 1},
+		{3, 1000, 128, 128, 1, 128},
+	}
+	for _, test := range tests {
+		img := Fit(image.NewRGBA(image.Rect(0, 0, test.w, test.h)), test.maxW, test.maxH)
+		if b := img.Bounds(); b != image.Rect(0, 0, test.dw, test.dh) {
+			t.Errorf("%dx%d into %dx%d: %v, want %dx%d", test.w, test.h, test.maxW, test.maxH, b.Size(), test.dw, test.dh)
+		}
+	}
+
+	empty := image.NewRGBA(image.Rect(0, 0, 0, 10))
+	if img := Fit(empty, 128, 128); img != image.Image(empty) {
+		t.Errorf("fitting an empty image: %v", img.Bounds())
+	}
+}
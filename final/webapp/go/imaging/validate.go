@@ -0,0 +1,69 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+)
+
+var ErrDimensions = errors.New("imaging: image dimensions exceed the limits")
+
+// Limits bound the dimensions of images that are decoded. Zero means no
+// limit.
+type Limits struct {
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+	MaxPixels int `json:"max_pixels"`
+}
+
+var magics = []struct {
+	format string
+	magic  string
+}{
+	{"jpeg", "\xff\xd8\xff"},
+	{"png", "\x89PNG\r\n\x1a\n"},
+	{"gif", "GIF87a"},
+	{"gif", "GIF89a"},
+}
+
+// Sniff names the format of data by its magic bytes, or returns "" if it is
+// not a JPEG, PNG or GIF.
+func Sniff(data []byte) string {
+	for _, m := range magics {
+		if bytes.HasPrefix(data, []byte(m.magic)) {
+			return m.format
+		}
+	}
+	return ""
+}
+
+// Check reports whether an image of w x h pixels is within l.
+func (l Limits) Check(w, h int) error {
+	if w <= 0 || h <= 0 {
+		return ErrDimensions
+	}
+	if (l.MaxWidth > 0 && w > l.MaxWidth) || (l.MaxHeight > 0 && h > l.MaxHeight) {
+		return ErrDimensions
+	}
+	if l.MaxPixels > 0 && int64(w)*int64(h) > int64(l.MaxPixels) {
+		return ErrDimensions
+	}
+	return nil
+}
+
+// DecodeLimited decodes data completely, but only after its header passed
+// l. A small file that claims huge dimensions is refused before any memory
+// is allocated for its pixels.
+func DecodeLimited(data []byte, l Limits) (image.Image, string, error) {
+	if Sniff(data) == "" {
+		return nil, "", ErrFormat
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := l.Check(cfg.Width, cfg.Height); err != nil {
+		return nil, "", err
+	}
+	return Decode(bytes.NewReader(data))
+}
@@ -0,0 +1,123 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func TestLimitsCheck(t *testing.T) {
+	l := Limits{MaxWidth: 4000, MaxHeight: 3000, MaxPixels: 6000000}
+	tests := []struct {
+		limits Limits
+		w, h   int
+		ok     bool
+	}{
+		{l, 1, 1, true},
+		{l, 4000, 1500, true},
+		{l, 2000, 3000, true},
+		{l, 4001, 1, false},
+		{l, 1, 3001, false},
+		{l, 3000, 2001, false},
+		{l, 0, 100, false},
+		{l, 100, -1, false},
+		// width times height does not overflow a 32 bit int into a small number
+		{Limits{MaxPixels: 100}, 1 << 16, 1 << 16, false},
+		{Limits{}, 100000, 100000, true},
+		{Limits{}, 0, 0, false},
+		{Limits{MaxWidth: 10}, 10, 100000, true},
+		{Limits{MaxHeight: 10}, 100000, 11, false},
+	}
+	for _, test := range tests {
+		err := test.limits.Check(test.w, test.h)
+		if (err == nil) != test.ok || (err != nil && err != ErrDimensions) {
+			t.Errorf("%+v, %dx%d: %v", test.limits, test.w, test.h, err)
+		}
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		data   string
+		format string
+	}{
+		{"\xff\xd8\xff\xe0", "jpeg"},
+		{"\x89PNG\r\n\x1a\n\x00", "png"},
+		{"GIF87a", "gif"},
+		{"GIF89a...", "gif"},
+		{"\xff\xd8", ""},
+		{"GIF88a", ""},
+		{"BM", ""},
+		{"<svg>", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if format := Sniff([]byte(test.data)); format != test.format {
+			t.Errorf("%q is %q, want %q", test.data, format, test.format)
+		}
+	}
+}
+
+// withPNGSize rewrites the IHDR chunk of a PNG to claim w x h pixels.
+func withPNGSize(data []byte, w, h uint32) []byte {
+	out := append([]byte{}, data...)
+	// signature, chunk length and type
+	ihdr := out[16:]
+	binary.BigEndian.PutUint32(ihdr, w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	binary.BigEndian.PutUint32(out[29:], crc32.ChecksumIEEE(out[12:29]))
+	return out
+}
+
+func TestDecodeLimited(t *testing.T) {
+	encode := func(format string, w, h int) []byte {
+		var buf bytes.Buffer
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		var err error
+		switch format {
+		case "png":
+			err = png.Encode(&buf, img)
+		case "gif":
+			err = gif.Encode(&buf, img, nil)
+		default:
+			err = Encode(&buf, img, format, Options{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	small := encode("png", 10, 10)
+	l := Limits{MaxWidth: 100, MaxHeight: 100, MaxPixels: 5000}
+	tests := []struct {
+		name   string
+		data   []byte
+		limits Limits
+		err    error
+	}{
+		{"jpeg", encode("jpeg", 100, 50), l, nil},
+		{"png", small, l, nil},
+		{"gif", encode("gif", 50, 100), l, nil},
+		{"too wide", encode("png", 101, 1), l, ErrDimensions},
+		{"too tall", encode("jpeg", 1, 101), l, ErrDimensions},
+		{"too many pixels", encode("gif", 100, 51), l, ErrDimensions},
+		{"no limits", encode("png", 300, 300), Limits{}, nil},
+		// a few bytes that would need gigabytes once decoded
+		{"claims to be huge", withPNGSize(small, 1<<20, 1<<20), l, ErrDimensions},
+		{"not an image", []byte("BM\x00\x00"), l, ErrFormat},
+		{"empty", nil, l, ErrFormat},
+	}
+	for _, test := range tests {
+		img, _, err := DecodeLimited(test.data, test.limits)
+		if err != test.err {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+		if err == nil && img == nil {
+			t.Errorf("%s: no image", test.name)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"./imaging"
+	"./storage"
+	"./thumbnail"
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	jobImage = "image"
+	jobIcon  = "icon"
+
+	jobPending = "pending"
+	jobFailed  = "failed"
+
+	defaultJobWorkers     = 4
+	defaultJobQueueSize   = 256
+	defaultJobMaxAttempts = 3
+	defaultJobRetryDelay  = 2 * time.Second
+	defaultJobSweep       = time.Minute
+	defaultJobRetention   = 7 * 24 * time.Hour
+)
+
+type JobConfig struct {
+	Workers     int `json:"workers"`
+	QueueSize   int `json:"queue_size"`
+	MaxAttempts int `json:"max_attempts"`
+	// RetryDelay is the delay before the first retry in milliseconds, it
+	// doubles with every further attempt
+	RetryDelay int `json:"retry_delay_ms"`
+	// Sweep is how often pending jobs are picked up again from the
+	// database in seconds, e.g. the ones that did not fit in the queue
+	Sweep int `json:"sweep_interval"`
+	// Retention in seconds is how long failed jobs are kept for a look at
+	// their last_error; jobs that succeed are deleted right away
+	Retention int `json:"failed_retention"`
+}
+
+type thumbnailJob struct {
+	Id       int64
+	Kind     string
+	Name     string
+	Attempts int
+}
+
+// jobQueue makes thumbnails in a fixed number of workers. Every job is a
+// row in thumbnail_jobs first, so a job that did not fit in the queue or
+// was lost with a restart is still pending there and is picked up again
+// by the sweep.
+type jobQueue struct {
+	jobs        chan *thumbnailJob
+	maxAttempts int
+	retryDelay  time.Duration
+	retention   time.Duration
+	mu          sync.Mutex
+	queued      map[int64]bool
+}
+
+var thumbnails *jobQueue
+
+func newJobQueue(c JobConfig) *jobQueue {
+	if c.Workers <= 0 {
+		c.Workers = defaultJobWorkers
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultJobQueueSize
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultJobMaxAttempts
+	}
+	q := &jobQueue{
+		jobs:        make(chan *thumbnailJob, c.QueueSize),
+		maxAttempts: c.MaxAttempts,
+		retryDelay:  defaultJobRetryDelay,
+		retention:   defaultJobRetention,
+		queued:      make(map[int64]bool),
+	}
+	if c.RetryDelay > 0 {
+		q.retryDelay = time.Duration(c.RetryDelay) * time.Millisecond
+	}
+	if c.Retention > 0 {
+		q.retention = time.Duration(c.Retention) * time.Second
+	}
+	sweep := defaultJobSweep
+	if c.Sweep > 0 {
+		sweep = time.Duration(c.Sweep) * time.Second
+	}
+	for i := 0; i < c.Workers; i++ {
+		go q.work()
+	}
+	go q.sweep(sweep)
+	return q
+}
+
+// enqueue records a job for the file name of kind and queues it.
+func (q *jobQueue) enqueue(kind string, name string) error {
+	result, err := dbConn.Exec(
+		"INSERT INTO thumbnail_jobs (kind, name, state, attempts, created_at, updated_at) VALUES (?, ?, ?, 0, NOW(), NOW())",
+		kind, name, jobPending,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	q.offer(&thumbnailJob{Id: id, Kind: kind, Name: name})
+	return nil
+}
+
+// offer queues job unless it is queued already or the queue is full, in
+// which case the sweep finds it later.
+func (q *jobQueue) offer(job *thumbnailJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[job.Id] {
+		return
+	}
+	select {
+	case q.jobs <- job:
+		q.queued[job.Id] = true
+	default:
+		log.Printf("thumbnail queue is full, job %d stays pending", job.Id)
+	}
+}
+
+func (q *jobQueue) done(job *thumbnailJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.queued, job.Id)
+}
+
+// sweep queues the pending jobs in the database now, which resumes the
+// jobs of a previous run, and then every interval. It also deletes the
+// jobs that failed longer than the retention ago.
+func (q *jobQueue) sweep(interval time.Duration) {
+	for {
+		_, err := dbConn.Exec(
+			"DELETE FROM thumbnail_jobs WHERE state <> ? AND updated_at < NOW() - INTERVAL ? SECOND",
+			jobPending, int(q.retention/time.Second),
+		)
+		if err != nil {
+			log.Printf("can't delete old thumbnail jobs: %v", err)
+		}
+		rows, err := dbConn.Query(
+			"SELECT id, kind, name, attempts FROM thumbnail_jobs WHERE state = ? ORDER BY id",
+			jobPending,
+		)
+		if err != nil {
+			log.Printf("can't load pending thumbnail jobs: %v", err)
+		} else {
+			jobs := []*thumbnailJob{}
+			for rows.Next() {
+				job := &thumbnailJob{}
+				rows.Scan(&job.Id, &job.Kind, &job.Name, &job.Attempts)
+				jobs = append(jobs, job)
+			}
+			rows.Close()
+			for _, job := range jobs {
+				q.offer(job)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (q *jobQueue) work() {
+	for job := range q.jobs {
+		err := runJob(job)
+		job.Attempts++
+		switch {
+		case err == nil:
+			q.finish(job)
+			q.done(job)
+		case job.Attempts < q.maxAttempts:
+			log.Printf("thumbnail job %d failed, retrying: %v", job.Id, err)
+			q.setState(job, jobPending, err.Error())
+			// still counts as queued, so the sweep leaves it alone
+			job := job
+			time.AfterFunc(q.retryDelay<<uint(job.Attempts-1), func() {
+				q.done(job)
+				q.offer(job)
+			})
+		default:
+			log.Printf("thumbnail job %d failed for good: %v", job.Id, err)
+			q.setState(job, jobFailed, err.Error())
+			q.done(job)
+		}
+	}
+}
+
+// finish deletes the row of a job that succeeded.
+func (q *jobQueue) finish(job *thumbnailJob) {
+	if _, err := dbConn.Exec("DELETE FROM thumbnail_jobs WHERE id = ?", job.Id); err != nil {
+		log.Printf("can't delete thumbnail job %d: %v", job.Id, err)
+	}
+}
+
+func (q *jobQueue) setState(job *thumbnailJob, state string, lastError string) {
+	_, err := dbConn.Exec(
+		"UPDATE thumbnail_jobs SET state = ?, attempts = ?, last_error = ?, updated_at = NOW() WHERE id = ?",
+		state, job.Attempts, lastError, job.Id,
+	)
+	if err != nil {
+		log.Printf("can't update thumbnail job %d: %v", job.Id, err)
+	}
+}
+
+// runJob makes the thumbnails of one file. A panic fails the job instead
+// of taking the worker down.
+func runJob(job *thumbnailJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	switch job.Kind {
+	case jobImage:
+		err = thumbnail.Image(blobs, "image/"+job.Name, config.Image)
+	case jobIcon:
+		err = thumbnail.Icon(blobs, "icon/"+job.Name, config.Image)
+	default:
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if err == storage.ErrNotFound {
+		// deleted before its thumbnails were made
+		return nil
+	}
+	return err
+}
+
+var placeholders sync.Map
+
+// placeholderIcon is a plain grey PNG of pixels x pixels, served for an
+// icon whose thumbnails are still being made.
+func placeholderIcon(pixels int) ([]byte, error) {
+	if data, ok := placeholders.Load(pixels); ok {
+		return data.([]byte), nil
+	}
+	square := image.NewGray(image.Rect(0, 0, pixels, pixels))
+	for i := range square.Pix {
+		square.Pix[i] = 0xcc
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, square, "png", imaging.Options{}); err != nil {
+		return nil, err
+	}
+	placeholders.Store(pixels, buf.Bytes())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"./imaging"
+	"./storage"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobsDB is the thumbnail_jobs table.
+type jobsDB struct {
+	mu     sync.Mutex
+	rows   map[int64]*jobRow
+	nextId int64
+	// sweeps counts the loads of the pending jobs
+	sweeps int
+}
+
+type jobRow struct {
+	kind      string
+	name      string
+	state     string
+	attempts  int64
+	lastError string
+	updated   time.Time
+}
+
+var testJobsDB *jobsDB
+
+// useJobsDB points dbConn at an empty jobsDB and blobs at a directory that
+// is removed after the test.
+func useJobsDB(t *testing.T) (*jobsDB, storage.BlobStore) {
+	oldConfig, oldConn, oldBlobs := config, dbConn, blobs
+	t.Cleanup(func() { config, dbConn, blobs = oldConfig, oldConn, oldBlobs })
+	dir := t.TempDir()
+	config = &Config{Datadir: dir}
+	blobs = storage.NewLocal(dir)
+	testJobsDB = &jobsDB{rows: map[int64]*jobRow{}}
+	var err error
+	if dbConn, err = sql.Open("jobstest", ""); err != nil {
+		t.Fatal(err)
+	}
+	return testJobsDB, blobs
+}
+
+// insert adds a job that was last updated age ago.
+func (db *jobsDB) insert(kind, name, state string, age time.Duration) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.nextId++
+	db.rows[db.nextId] = &jobRow{kind: kind, name: name, state: state, updated: time.Now().Add(-age)}
+	return db.nextId
+}
+
+func (db *jobsDB) row(id int64) (jobRow, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r, ok := db.rows[id]
+	if !ok {
+		return jobRow{}, false
+	}
+	return *r, true
+}
+
+func (db *jobsDB) ids() []int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ids := []int64{}
+	for id := range db.rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// startJobQueue starts a queue and waits for its first sweep, so the sweep
+// of an earlier queue can not take the jobs of this test.
+func startJobQueue(t *testing.T, db *jobsDB, c JobConfig) *jobQueue {
+	c.Sweep = 3600
+	q := newJobQueue(c)
+	waitFor(t, "the first sweep", func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.sweeps > 0
+	})
+	return q
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type jobsConn struct{}
+type jobsStmt struct{ query string }
+type jobsResult int64
+
+func (jobsConn) Prepare(query string) (driver.Stmt, error) { return jobsStmt{query}, nil }
+func (jobsConn) Close() error                              { return nil }
+func (jobsConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s jobsStmt) Close() error  { return nil }
+func (s jobsStmt) NumInput() int { return -1 }
+
+func (r jobsResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r jobsResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (s jobsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := testJobsDB
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch s.query {
+	case "INSERT INTO thumbnail_jobs (kind, name, state, attempts, created_at, updated_at) VALUES (?, ?, ?, 0, NOW(), NOW())":
+		db.nextId++
+		db.rows[db.nextId] = &jobRow{kind: args[0].(string), name: args[1].(string), state: args[2].(string), updated: time.Now()}
+		return jobsResult(db.nextId), nil
+	case "DELETE FROM thumbnail_jobs WHERE id = ?":
+		delete(db.rows, args[0].(int64))
+		return jobsResult(0), nil
+	case "UPDATE thumbnail_jobs SET state = ?, attempts = ?, last_error = ?, updated_at = NOW() WHERE id = ?":
+		if r, ok := db.rows[args[3].(int64)]; ok {
+			r.state, r.attempts, r.lastError, r.updated = args[0].(string), args[1].(int64), args[2].(string), time.Now()
+		}
+		return jobsResult(0), nil
+	case "DELETE FROM thumbnail_jobs WHERE state <> ? AND updated_at < NOW() - INTERVAL ? SECOND":
+		before := time.Now().Add(-time.Duration(args[1].(int64)) * time.Second)
+		for id, r := range db.rows {
+			if r.state != args[0].(string) && r.updated.Before(before) {
+				delete(db.rows, id)
+			}
+		}
+		return jobsResult(0), nil
+	}
+	return nil, fmt.Errorf("unexpected exec %q", s.query)
+}
+
+func (s jobsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := testJobsDB
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if s.query != "SELECT id, kind, name, attempts FROM thumbnail_jobs WHERE state = ? ORDER BY id" {
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	db.sweeps++
+	rows := &timelineRows{columns: []string{"id", "kind", "name", "attempts"}}
+	for id := int64(1); id <= db.nextId; id++ {
+		if r, ok := db.rows[id]; ok && r.state == args[0].(string) {
+			rows.values = append(rows.values, []driver.Value{id, r.kind, r.name, r.attempts})
+		}
+	}
+	return rows, nil
+}
+
+type jobsDriver struct{}
+
+func (jobsDriver) Open(name string) (driver.Conn, error) { return jobsConn{}, nil }
+
+func init() {
+	sql.Register("jobstest", jobsDriver{})
+}
+
+// flakyStore fails the first fails lookups of a thumbnail, or panics on
+// them, and notes when they were made.
+type flakyStore struct {
+	storage.BlobStore
+	mu     sync.Mutex
+	fails  int
+	panics bool
+	tries  []time.Time
+}
+
+func (s *flakyStore) Exists(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasSuffix(key, "_s.jpg") {
+		s.tries = append(s.tries, time.Now())
+	}
+	if s.fails > 0 {
+		s.fails--
+		if s.panics {
+			panic("corrupt store")
+		}
+		return false, errors.New("store unavailable")
+	}
+	return s.BlobStore.Exists(key)
+}
+
+func (s *flakyStore) attempts() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time{}, s.tries...)
+}
+
+func putJPEG(t *testing.T, store storage.BlobStore, key string) {
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20)), "jpeg", imaging.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(key, buf.Bytes(), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobRetries(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	tests := []struct {
+		name   string
+		fails  int
+		panics bool
+		// the job has no image to make thumbnails of
+		gone     bool
+		attempts int
+		// failed, or "" if the job is done and deleted
+		state     string
+		lastError string
+	}{
+		{"first try", 0, false, false, 1, "", ""},
+		{"retried", 2, false, false, 3, "", ""},
+		{"gives up", 3, false, false, 3, jobFailed, "store unavailable"},
+		{"panics", 5, true, false, 3, jobFailed, "panic: corrupt store"},
+		{"image deleted", 0, false, true, 1, "", ""},
+	}
+	for _, test := range tests {
+		db, local := useJobsDB(t)
+		store := &flakyStore{BlobStore: local, fails: test.fails, panics: test.panics}
+		blobs = store
+		if !test.gone {
+			putJPEG(t, local, "image/abc.jpg")
+		}
+		q := startJobQueue(t, db, JobConfig{Workers: 1, MaxAttempts: 3, RetryDelay: int(delay / time.Millisecond)})
+
+		if err := q.enqueue(jobImage, "abc.jpg"); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, test.name, func() bool {
+			r, ok := db.row(1)
+			return !ok || r.state == jobFailed
+		})
+
+		r, ok := db.row(1)
+		if test.state == "" && ok {
+			t.Errorf("%s: job left %+v", test.name, r)
+		}
+		if test.state != "" && (r.state != test.state || r.attempts != int64(test.attempts) || r.lastError != test.lastError) {
+			t.Errorf("%s: job %+v, want %s after %d attempts with %q", test.name, r, test.state, test.attempts, test.lastError)
+		}
+		tries := store.attempts()
+		if len(tries) != test.attempts {
+			t.Errorf("%s: %d attempts, want %d", test.name, len(tries), test.attempts)
+		}
+		// the delay doubles with every retry
+		for i := 1; i < len(tries); i++ {
+			if d := tries[i].Sub(tries[i-1]); d < delay<<uint(i-1) {
+				t.Errorf("%s: retry %d after %v, want %v", test.name, i, d, delay<<uint(i-1))
+			}
+		}
+		if ok, _ := local.Exists("image/abc_m.jpg"); ok != (test.state == "" && !test.gone) {
+			t.Errorf("%s: thumbnail made: %v", test.name, ok)
+		}
+	}
+}
+
+func TestJobSweep(t *testing.T) {
+	db, store := useJobsDB(t)
+	putJPEG(t, store, "image/abc.jpg")
+	day := 24 * time.Hour
+	oldFailed := db.insert(jobImage, "old.jpg", jobFailed, 8*day)
+	newFailed := db.insert(jobImage, "new.jpg", jobFailed, 6*day)
+	// left pending by an earlier run, it is resumed however old it is
+	pending := db.insert(jobImage, "abc.jpg", jobPending, 30*day)
+	startJobQueue(t, db, JobConfig{})
+
+	waitFor(t, "the pending job", func() bool {
+		_, ok := db.row(pending)
+		return !ok
+	})
+	if ids := db.ids(); len(ids) != 1 || ids[0] != newFailed {
+		t.Errorf("jobs %v left, want %d and not %d", ids, newFailed, oldFailed)
+	}
+	if ok, _ := store.Exists("image/abc_s.jpg"); !ok {
+		t.Error("the resumed job made no thumbnail")
+	}
+
+	// a shorter retention takes the newer failure too
+	db, _ = useJobsDB(t)
+	failed := db.insert(jobIcon, "x.png", jobFailed, 2*time.Hour)
+	kept := db.insert(jobIcon, "y.png", jobFailed, 30*time.Minute)
+	startJobQueue(t, db, JobConfig{Retention: 3600})
+	if _, ok := db.row(failed); ok {
+		t.Error("a job that failed before the retention was kept")
+	}
+	if _, ok := db.row(kept); !ok {
+		t.Error("a job that failed within the retention was deleted")
+	}
+}
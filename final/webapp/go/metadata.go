@@ -0,0 +1,82 @@
+package main
+
+import (
+	"./imaging"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"image"
+	"net/http"
+)
+
+// quality for originals that have to be encoded again to turn them upright
+const originalQuality = 92
+
+// storedImage is what is kept of an uploaded JPEG. Its metadata is dropped
+// unless upload.keep_metadata is set, and a photo that relied on its EXIF
+// orientation is encoded upright again, as the tag goes with the rest.
+func storedImage(data []byte, img image.Image, meta *imaging.Metadata) ([]byte, error) {
+	if config.Upload.KeepMetadata {
+		return data, nil
+	}
+	if meta != nil && meta.Orientation > 1 {
+		var buf bytes.Buffer
+		err := imaging.Encode(&buf, img, "jpeg", imaging.Options{Quality: originalQuality})
+		return buf.Bytes(), err
+	}
+	return imaging.StripMetadata(data)
+}
+
+// saveMetadata keeps the camera metadata of an entry whose owner asked
+// for it with keep_metadata=1 when posting.
+func saveMetadata(entryId int, meta *imaging.Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = dbConn.Exec(
+		"INSERT INTO entry_metadata (entry_id, data, created_at) VALUES (?, ?, NOW())",
+		entryId, string(b),
+	)
+	return err
+}
+
+func entryMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var entryId, owner int
+	var data string
+	err = dbConn.QueryRow(
+		"SELECT entries.id, entries.user, entry_metadata.data FROM entries JOIN entry_metadata ON (entry_metadata.entry_id = entries.id) WHERE entries.id = ?", id,
+	).Scan(
+		&entryId, &owner, &data,
+	)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	// only the owner may see where a photo was taken
+	if owner != user.Id {
+		notFound(w)
+		return
+	}
+
+	renderJsonNoCache(w, Response{"id": entryId, "metadata": json.RawMessage(data)})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"./imaging"
+	"./thumbnail"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	fitCrop    = "crop"
+	fitContain = "contain"
+)
+
+var (
+	defaultResizeSizes = []int{32, 64, 128, 256, 512, 1024}
+	defaultResizeDPR   = []float64{1, 2, 3}
+
+	errResizeParams = errors.New("unsupported resize parameters")
+)
+
+// ResizeConfig lists the widths and heights, in CSS pixels, and the
+// device pixel ratios that may be asked for. Anything else is refused, so
+// clients can't fill the cache with arbitrary variants.
+type ResizeConfig struct {
+	Sizes    []int     `json:"sizes"`
+	DPR      []float64 `json:"dpr"`
+	CacheDir string    `json:"cache_dir"`
+}
+
+func (c ResizeConfig) sizes() []int {
+	if len(c.Sizes) == 0 {
+		return defaultResizeSizes
+	}
+	return c.Sizes
+}
+
+func (c ResizeConfig) dprs() []float64 {
+	if len(c.DPR) == 0 {
+		return defaultResizeDPR
+	}
+	return c.DPR
+}
+
+func (c ResizeConfig) cacheDir() string {
+	if c.CacheDir == "" {
+		return config.Datadir + "/cache"
+	}
+	return c.CacheDir
+}
+
+type resizeSpec struct {
+	W   int
+	H   int
+	Fit string
+	DPR float64
+}
+
+func wantsResize(r *http.Request) bool {
+	return r.FormValue("w") != "" || r.FormValue("h") != ""
+}
+
+// parseResizeSpec reads w, h, fit and dpr. A missing w or h is the same as
+// the other one, fit is crop unless it is contain, and dpr defaults to 1.
+func parseResizeSpec(r *http.Request, c ResizeConfig) (*resizeSpec, error) {
+	spec := &resizeSpec{Fit: fitCrop, DPR: 1}
+	var err error
+	if v := r.FormValue("w"); v != "" {
+		if spec.W, err = strconv.Atoi(v); err != nil {
+			return nil, errResizeParams
+		}
+	}
+	if v := r.FormValue("h"); v != "" {
+		if spec.H, err = strconv.Atoi(v); err != nil {
+			return nil, errResizeParams
+		}
+	}
+	if spec.W == 0 {
+		spec.W = spec.H
+	}
+	if spec.H == 0 {
+		spec.H = spec.W
+	}
+	if !containsInt(c.sizes(), spec.W) || !containsInt(c.sizes(), spec.H) {
+		return nil, errResizeParams
+	}
+	switch fit := r.FormValue("fit"); fit {
+	case "", fitCrop:
+	case fitContain:
+		spec.Fit = fitContain
+	default:
+		return nil, errResizeParams
+	}
+	if v := r.FormValue("dpr"); v != "" {
+		if spec.DPR, err = strconv.ParseFloat(v, 64); err != nil || !containsFloat(c.dprs(), spec.DPR) {
+			return nil, errResizeParams
+		}
+	}
+	return spec, nil
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFloat(list []float64, v float64) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// pixels is the size of the variant in device pixels.
+func (spec *resizeSpec) pixels() (int, int) {
+	return int(math.Round(float64(spec.W) * spec.DPR)), int(math.Round(float64(spec.H) * spec.DPR))
+}
+
+// cacheName is e.g. 0123abcd_128x128_crop@2x.jpg
+func (spec *resizeSpec) cacheName(id string, ext string) string {
+	return fmt.Sprintf("%s_%dx%d_%s@%sx%s", id, spec.W, spec.H, spec.Fit,
+		strconv.FormatFloat(spec.DPR, 'f', -1, 64), ext)
+}
+
+// flightGroup runs one call per key at a time; callers that come while it
+// runs wait for it and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+func (g *flightGroup) do(key string, fn func() error) error {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.err
+}
+
+var resizes flightGroup
+
+// resizedFile returns the path of the variant of the blob orig described
+// by spec, making it first unless it is in the cache already. The cache is
+// on local disk even when the blobs are not.
+func resizedFile(kind string, id string, orig string, spec *resizeSpec) (string, error) {
+	ext := filepath.Ext(orig)
+	path := filepath.Join(config.Resize.cacheDir(), kind, spec.cacheName(id, ext))
+	if FileExists(path) {
+		return path, nil
+	}
+	err := resizes.do(path, func() error {
+		if FileExists(path) {
+			return nil
+		}
+		img, err := thumbnail.Load(blobs, orig)
+		if err != nil {
+			return err
+		}
+		w, h := spec.pixels()
+		if spec.Fit == fitContain {
+			img = imaging.Fit(img, w, h)
+		} else {
+			img = imaging.Fill(img, w, h)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return imaging.EncodeFile(path, img, config.Image)
+	})
+	return path, err
+}
+
+// serveResized answers an image or icon request that has w or h in it.
+func serveResized(w http.ResponseWriter, r *http.Request, kind string, id string, orig string) {
+	spec, err := parseResizeSpec(r, config.Resize)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	path, err := resizedFile(kind, id, orig, spec)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// removeResized drops the cached variants of an image or icon.
+func removeResized(kind string, id string) {
+	paths, _ := filepath.Glob(filepath.Join(config.Resize.cacheDir(), kind, id+"_*"))
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("can't delete %s: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sharedFiles are kept the same in the qualifier app, which builds on its
+// own and so has copies of them.
+var sharedFiles = []string{"assets.go", "compress.go", "tls.go", "gen_assets.sh"}
+
+func TestSharedFilesMatchQualifier(t *testing.T) {
+	qualifier := filepath.Join("..", "..", "..", "qualifier", "webapp", "go")
+	if _, err := os.Stat(qualifier); os.IsNotExist(err) {
+		t.Skip("the qualifier app is not next to this one")
+	}
+	for _, name := range sharedFiles {
+		ours, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs, err := ioutil.ReadFile(filepath.Join(qualifier, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ours, theirs) {
+			t.Errorf("%s differs from %s, change both copies together", name, filepath.Join(qualifier, name))
+		}
+	}
+}
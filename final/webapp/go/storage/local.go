@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Local keeps blobs as files under a directory, the key being the path.
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// path is where the blob at key is kept. Keys that are absolute or have a
+// ".." segment would reach outside the directory and are refused.
+func (s *Local) path(key string) (string, error) {
+	if strings.HasPrefix(key, "/") || filepath.IsAbs(key) {
+		return "", ErrInvalidKey
+	}
+	for _, seg := range strings.Split(filepath.ToSlash(key), "/") {
+		if seg == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *Local) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *Local) Put(key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".blob")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *Local) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *Local) Exists(key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Local) List(prefix string) ([]Blob, error) {
+	blobs := []Blob{}
+	// only the directory the prefix is in has to be walked
+	root, err := s.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		// skip the temporary files of unfinished puts
+		if strings.HasPrefix(key, prefix) && !strings.HasPrefix(filepath.Base(path), ".") {
+			blobs = append(blobs, Blob{Key: key, Modified: fi.ModTime()})
+		}
+		return nil
+	})
+	return blobs, err
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalRejectsKeysOutsideItsDirectory(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	s := NewLocal(dir)
+	if err := ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"../secret",
+		"image/../../secret",
+		"image/..",
+		"..",
+		"/etc/passwd",
+		filepath.Join(root, "secret"),
+		"icon/a/../../../secret",
+	} {
+		if _, err := s.Get(key); err != ErrInvalidKey {
+			t.Errorf("Get %q: %v", key, err)
+		}
+		if err := s.Put(key, []byte("x"), "image/png"); err != ErrInvalidKey {
+			t.Errorf("Put %q: %v", key, err)
+		}
+		if err := s.Delete(key); err != ErrInvalidKey {
+			t.Errorf("Delete %q: %v", key, err)
+		}
+		if _, err := s.Exists(key); err != ErrInvalidKey {
+			t.Errorf("Exists %q: %v", key, err)
+		}
+	}
+	if _, err := s.List("../"); err != ErrInvalidKey {
+		t.Errorf("List ../: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "secret")); err != nil || string(data) != "secret" {
+		t.Errorf("the file outside is %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "x")); !os.IsNotExist(err) {
+		t.Errorf("something was written outside: %v", err)
+	}
+}
+
+func TestLocalKeys(t *testing.T) {
+	s := NewLocal(t.TempDir())
+	for _, key := range []string{"image/abc.jpg", "icon/default_s.png", "a..b/c..", "image/x.jpg", "icon/..png"} {
+		if err := s.Put(key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+		if data, err := ReadAll(s, key); err != nil || string(data) != key {
+			t.Errorf("Get %q: %q, %v", key, data, err)
+		}
+	}
+	if _, err := s.Get("image/missing.jpg"); err != ErrNotFound {
+		t.Errorf("Get of a missing blob: %v", err)
+	}
+	blobs, err := s.List("image/")
+	if err != nil || len(blobs) != 2 {
+		t.Errorf("List image/: %v, %v", blobs, err)
+	}
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat    = "20060102T150405Z"
+)
+
+type S3Config struct {
+	// Endpoint is e.g. https://s3.ap-northeast-1.amazonaws.com, or the URL
+	// of any S3 compatible server
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	// PathStyle puts the bucket in the path instead of the host name, which
+	// most self-hosted servers want
+	PathStyle bool `json:"path_style"`
+}
+
+// S3 keeps blobs as objects in a bucket, signing requests with AWS
+// Signature Version 4.
+type S3 struct {
+	config S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3(c S3Config) (*S3, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, fmt.Errorf("storage: s3 needs an endpoint and a bucket")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	return &S3{config: c, client: &http.Client{Timeout: 30 * time.Second}, now: time.Now}, nil
+}
+
+// S3Error is an error response of the server.
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("storage: s3 %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (s *S3) url(key string, query url.Values) string {
+	u := s.config.Endpoint
+	if s.config.PathStyle {
+		u += "/" + s.config.Bucket
+	} else {
+		i := strings.Index(u, "://") + 3
+		u = u[:i] + s.config.Bucket + "." + u[i:]
+	}
+	u += "/" + escapePath(key)
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	return u
+}
+
+func (s *S3) do(method string, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &S3Error{Status: resp.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(b, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Put(key string, data []byte, contentType string) error {
+	resp, err := s.do("PUT", key, nil, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, "")
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Exists(key string) (bool, error) {
+	resp, err := s.do("HEAD", key, nil, nil, "")
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(prefix string) ([]Blob, error) {
+	blobs := []Blob{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			blobs = append(blobs, Blob{Key: c.Key, Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// sign adds the Signature Version 4 Authorization header. The host, the
+// x-amz-* headers, Content-Type and Range are signed.
+func (s *S3) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath escapes every segment of key the way Signature Version 4
+// expects, keeping the slashes.
+func escapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escape(name)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape is URI encoding as AWS defines it: everything but the unreserved
+// characters, with upper case hex digits.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
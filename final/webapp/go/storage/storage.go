@@ -0,0 +1,59 @@
+// Package storage keeps the images and icons, either in a local directory
+// or in an S3 compatible bucket that several app hosts can share.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+var ErrNotFound = errors.New("storage: blob not found")
+
+// BlobStore holds blobs under slash separated keys such as
+// "image/<hash>.jpg".
+type BlobStore interface {
+	// Get returns ErrNotFound if there is no blob at key.
+	Get(key string) (io.ReadCloser, error)
+	// Put replaces the blob at key as a whole; readers never see part of it.
+	Put(key string, data []byte, contentType string) error
+	// Delete succeeds if there is no blob at key.
+	Delete(key string) error
+	Exists(key string) (bool, error)
+	// List returns the blobs whose keys start with prefix.
+	List(prefix string) ([]Blob, error)
+}
+
+// Blob is a listed blob and when it was last put.
+type Blob struct {
+	Key      string
+	Modified time.Time
+}
+
+// Config picks the store: "local" (the default) keeps the blobs under the
+// data directory, "s3" in the bucket of S3.
+type Config struct {
+	Type string   `json:"type"`
+	S3   S3Config `json:"s3"`
+}
+
+func New(c Config, datadir string) (BlobStore, error) {
+	switch c.Type {
+	case "", "local":
+		return NewLocal(datadir), nil
+	case "s3":
+		return NewS3(c.S3)
+	}
+	return nil, fmt.Errorf("storage: unknown type %q", c.Type)
+}
+
+func ReadAll(s BlobStore, key string) ([]byte, error) {
+	rc, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
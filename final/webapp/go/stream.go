@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultStreamHeartbeat    = 15 * time.Second
+	defaultStreamWriteTimeout = 10 * time.Second
+	// sseRetry is how long EventSource waits before reconnecting, in ms
+	sseRetry = 3000
+)
+
+func (c TimelineConfig) heartbeat() time.Duration {
+	if c.Heartbeat <= 0 {
+		return defaultStreamHeartbeat
+	}
+	return time.Duration(c.Heartbeat) * time.Second
+}
+
+func (c TimelineConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout <= 0 {
+		return defaultStreamWriteTimeout
+	}
+	return time.Duration(c.WriteTimeout) * time.Second
+}
+
+// timelineSink is one streaming connection. Both methods block until the
+// client has taken the message or the write timeout is over.
+type timelineSink interface {
+	send(page *timelinePage) error
+	heartbeat() error
+}
+
+// timelineStreamHandler pushes the timeline over Server-Sent Events, or
+// over a WebSocket if the client asks for the upgrade. Every message is a
+// timeline response. A client resumes after the entry in Last-Event-ID or
+// latest_entry; without either it first gets the latest entries.
+func timelineStreamHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.FormValue("latest_entry")
+	}
+	latestEntryId, err := strconv.Atoi(resume)
+	if err != nil {
+		latestEntryId = 0
+	}
+
+	var sink timelineSink
+	ctx := r.Context()
+	if websocket.IsWebSocketUpgrade(r) {
+		ws, err := newWebSocketSink(w, r)
+		if err != nil {
+			// the upgrader has answered already
+			log.Printf("websocket upgrade failed: %v", err)
+			return
+		}
+		defer ws.conn.Close()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go ws.readUntilClosed(cancel)
+		sink = ws
+	} else {
+		sse, err := newSSESink(w)
+		if err != nil {
+			log.Printf("can't start timeline stream: %v", err)
+			return
+		}
+		defer sse.close()
+		sink = sse
+	}
+
+	if err := streamTimeline(ctx, sink, baseUrl, user, latestEntryId); err != nil {
+		log.Printf("timeline stream of user %d ended: %v", user.Id, err)
+	}
+}
+
+// streamTimeline sends the entries after latestEntryId, then more as they
+// are posted, until ctx is done or a write fails. Nothing is queued per
+// connection: wake-ups coalesce, and a client that reads slowly is only
+// sent the next batch once it has taken the last one, so it gets fewer and
+// larger messages. One that stops reading hits the write timeout.
+func streamTimeline(ctx context.Context, sink timelineSink, baseUrl *url.URL, user *User, latestEntryId int) error {
+	sub := timeline.subscribe(user.Id)
+	defer timeline.unsubscribe(sub)
+
+	heartbeat := time.NewTicker(config.Timeline.heartbeat())
+	defer heartbeat.Stop()
+	var poll <-chan time.Time
+	if config.Timeline.PollInterval > 0 {
+		t := time.NewTicker(time.Duration(config.Timeline.PollInterval) * time.Second)
+		defer t.Stop()
+		poll = t.C
+	}
+
+	for {
+		// catch up a page at a time
+		for {
+			page, err := loadTimeline(baseUrl, user, latestEntryId, 0)
+			if err != nil {
+				return err
+			}
+			if len(page.Entries) == 0 {
+				break
+			}
+			latestEntryId = page.LatestEntry
+			if err := sink.send(page); err != nil {
+				return err
+			}
+			if len(page.Entries) < config.Timeline.pageSize() {
+				break
+			}
+		}
+
+		for woken := false; !woken; {
+			select {
+			case <-sub.wake:
+				woken = true
+			case <-poll:
+				woken = true
+			case <-heartbeat.C:
+				if err := sink.heartbeat(); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+type sseSink struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func newSSESink(w http.ResponseWriter) (*sseSink, error) {
+	s := &sseSink{w: w, rc: http.NewResponseController(w), timeout: config.Timeline.writeTimeout()}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// keep proxies such as nginx from buffering the stream
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return s, s.write(fmt.Sprintf("retry: %d\n\n", sseRetry))
+}
+
+func (s *sseSink) write(message string) error {
+	if err := s.rc.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := fmt.Fprint(s.w, message); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// close clears the write deadline, the connection may serve more requests.
+func (s *sseSink) close() {
+	s.rc.SetWriteDeadline(time.Time{})
+}
+
+func (s *sseSink) send(page *timelinePage) error {
+	return s.write(fmt.Sprintf("id: %d\ndata: %s\n\n", page.LatestEntry, page.response()))
+}
+
+func (s *sseSink) heartbeat() error {
+	return s.write(": ping\n\n")
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+type webSocketSink struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+	idle    time.Duration
+}
+
+func newWebSocketSink(w http.ResponseWriter, r *http.Request) (*webSocketSink, error) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &webSocketSink{
+		conn:    conn,
+		timeout: config.Timeline.writeTimeout(),
+		// a client that misses two pings is gone
+		idle: 2*config.Timeline.heartbeat() + config.Timeline.writeTimeout(),
+	}
+	return s, nil
+}
+
+// readUntilClosed reads what the client sends, which is only needed for
+// the pongs and the close message, and calls done when the connection is
+// closed or stays silent for too long.
+func (s *webSocketSink) readUntilClosed(done func()) {
+	defer done()
+	s.conn.SetReadLimit(512)
+	s.conn.SetReadDeadline(time.Now().Add(s.idle))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(s.idle))
+	})
+	for {
+		if _, _, err := s.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *webSocketSink) send(page *timelinePage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	return s.conn.WriteMessage(websocket.TextMessage, []byte(page.response().String()))
+}
+
+func (s *webSocketSink) heartbeat() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.timeout))
+}
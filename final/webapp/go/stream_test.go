@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStreamServer serves timelineStreamHandler until the test is over and
+// the streams it opened are closed.
+func newStreamServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(timelineStreamHandler))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// openStream requests /timeline/stream as user with the given headers and
+// returns the body, cancel closes the request.
+func openStream(t *testing.T, srv *httptest.Server, user int, query string, header http.Header) (*bufio.Reader, *http.Response, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/timeline/stream"+query, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-API-Key", apiKey(user))
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		res.Body.Close()
+	})
+	return bufio.NewReader(res.Body), res, cancel
+}
+
+// readEvent returns the lines of the next event, without the blank line
+// that ends it.
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v after %q", err, lines)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+type streamedPage struct {
+	LatestEntry int `json:"latest_entry"`
+	Entries     []struct {
+		Id int `json:"id"`
+	} `json:"entries"`
+}
+
+func (p *streamedPage) ids() []int {
+	ids := []int{}
+	for _, e := range p.Entries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+// readPage reads an event that carries a page and checks its id.
+func readPage(t *testing.T, r *bufio.Reader, wantId int, wantEntries ...int) {
+	lines := readEvent(t, r)
+	if len(lines) != 2 || lines[0] != "id: "+strconv.Itoa(wantId) || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("event %q, want id %d and data", lines, wantId)
+	}
+	page := &streamedPage{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), page); err != nil {
+		t.Fatal(err)
+	}
+	if page.LatestEntry != wantId || !equalIds(page.ids(), wantEntries) {
+		t.Fatalf("page has latest_entry %d and entries %v, want %d and %v", page.LatestEntry, page.ids(), wantId, wantEntries)
+	}
+}
+
+func equalIds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStreamSSEFraming(t *testing.T) {
+	db := useTimelineDB(t)
+	db.post(1, 2)
+	db.post(2, 2)
+	srv := newStreamServer(t)
+
+	r, res, _ := openStream(t, srv, 1, "", nil)
+	for k, want := range map[string]string{"Content-Type": "text/event-stream", "Cache-Control": "no-cache", "X-Accel-Buffering": "no"} {
+		if got := res.Header.Get(k); got != want {
+			t.Errorf("%s is %q, want %q", k, got, want)
+		}
+	}
+	if lines := readEvent(t, r); len(lines) != 1 || lines[0] != "retry: 3000" {
+		t.Fatalf("first event %q, want the retry", lines)
+	}
+	readPage(t, r, 2, 2, 1)
+	db.post(3, 2)
+	readPage(t, r, 3, 3)
+}
+
+func TestStreamResume(t *testing.T) {
+	db := useTimelineDB(t)
+	config.Timeline.PageSize = 2
+	for i := 0; i < 5; i++ {
+		db.post(1, 2)
+	}
+	srv := newStreamServer(t)
+
+	tests := []struct {
+		query  string
+		header http.Header
+		// the pages that are sent first, by their ids
+		want [][]int
+	}{
+		{"", nil, [][]int{{5, 4}}},
+		{"?latest_entry=3", nil, [][]int{{5, 4}}},
+		// the catch-up goes a page at a time
+		{"", http.Header{"Last-Event-Id": {"1"}}, [][]int{{3, 2}, {5, 4}}},
+		// what EventSource says wins over the URL it was opened with
+		{"?latest_entry=1", http.Header{"Last-Event-Id": {"4"}}, [][]int{{5}}},
+	}
+	for _, test := range tests {
+		r, _, cancel := openStream(t, srv, 1, test.query, test.header)
+		readEvent(t, r)
+		for _, ids := range test.want {
+			readPage(t, r, ids[0], ids...)
+		}
+		cancel()
+	}
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	useTimelineDB(t)
+	config.Timeline.Heartbeat = 1
+	srv := newStreamServer(t)
+
+	r, _, _ := openStream(t, srv, 1, "", nil)
+	readEvent(t, r)
+	start := time.Now()
+	if lines := readEvent(t, r); len(lines) != 1 || lines[0] != ": ping" {
+		t.Fatalf("idle stream sent %q, want a ping", lines)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("pinged after %v", d)
+	}
+}
+
+// blockingSink hands every page to the test and waits until it is let go.
+type blockingSink struct {
+	pages   chan *timelinePage
+	release chan bool
+}
+
+func (s *blockingSink) send(page *timelinePage) error {
+	s.pages <- page
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) heartbeat() error { return nil }
+
+func TestStreamCoalescesForSlowConsumer(t *testing.T) {
+	db := useTimelineDB(t)
+	sink := &blockingSink{pages: make(chan *timelinePage), release: make(chan bool)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- streamTimeline(ctx, sink, &url.URL{}, &User{Id: 1}, 0)
+	}()
+
+	db.post(1, 2)
+	if page := <-sink.pages; page.LatestEntry != 1 || len(page.Entries) != 1 {
+		t.Fatalf("first page %+v", page)
+	}
+	// posted while the client is still taking the first page
+	db.post(1, 2)
+	db.post(2, 2)
+	db.post(3, 2)
+	sink.release <- true
+	if page := <-sink.pages; page.LatestEntry != 4 || len(page.Entries) != 3 {
+		t.Fatalf("second page %+v, want the 3 entries at once", page)
+	}
+	sink.release <- true
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := timeline.subscribers(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+}
+
+// stalledWriter is a connection whose client stopped reading once stall is
+// set: writes block until the write deadline passes.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	mu       sync.Mutex
+	stall    bool
+	deadline time.Time
+}
+
+func (w *stalledWriter) SetWriteDeadline(t time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deadline = t
+	return nil
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	stall, deadline := w.stall, w.deadline
+	w.mu.Unlock()
+	if !stall {
+		return w.ResponseRecorder.Write(b)
+	}
+	if deadline.IsZero() {
+		return 0, errors.New("write without a deadline")
+	}
+	time.Sleep(time.Until(deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestStreamDropsStalledConsumer(t *testing.T) {
+	db := useTimelineDB(t)
+	config.Timeline.WriteTimeout = 1
+	w := &stalledWriter{ResponseRecorder: httptest.NewRecorder()}
+	sink, err := newSSESink(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.mu.Lock()
+	w.stall = true
+	w.mu.Unlock()
+
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		done <- streamTimeline(context.Background(), sink, &url.URL{}, &User{Id: 1}, 0)
+	}()
+	db.post(1, 2)
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("stream ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream to a stalled client did not end")
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("dropped after %v, before the write timeout", d)
+	}
+	if n := timeline.subscribers(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+}
+
+// TestStreamsDoNotLeak disconnects many SSE and WebSocket clients and
+// checks that their handlers, goroutines and subscriptions are all gone.
+func TestStreamsDoNotLeak(t *testing.T) {
+	useTimelineDB(t)
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		timelineStreamHandler(w, r)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{}}
+	before := runtime.NumGoroutine()
+
+	var cancels []context.CancelFunc
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+		req.Header.Set("X-API-Key", apiKey(i+1))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		cancels = append(cancels, cancel)
+	}
+	var conns []*websocket.Conn
+	for i := 0; i < 50; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"X-Api-Key": {apiKey(i + 1)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	deadline := time.Now().Add(time.Second)
+	for timeline.subscribers() < 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := timeline.subscribers(); n != 100 {
+		t.Fatalf("%d subscriptions for 100 streams", n)
+	}
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	handlersDone := make(chan bool)
+	go func() {
+		handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handlers still running after their clients left")
+	}
+	client.CloseIdleConnections()
+
+	if n := timeline.subscribers(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+	deadline = time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines before, %d after", before, n)
+	}
+}
@@ -0,0 +1,98 @@
+// Package thumbnail makes the sizes of entry images and user icons that are
+// served next to the originals. The app runs it from its upload jobs and
+// goconvert over whole stores.
+package thumbnail
+
+import (
+	"../imaging"
+	"../storage"
+	"bytes"
+	"image"
+	"log"
+	"path"
+	"regexp"
+)
+
+// Sizes in pixels. Entry images are cropped to their center square first,
+// icons are square already.
+const (
+	IconS  = 32
+	IconM  = 64
+	IconL  = 128
+	ImageS = 128
+	ImageM = 256
+)
+
+var (
+	imageName = regexp.MustCompile("^([0-9a-f]+)(_(?:s|m|l))?.jpg$")
+	iconName  = regexp.MustCompile("^([0-9a-z]+)(_(?:s|m|l))?.png$")
+)
+
+type size struct {
+	name   string
+	pixels int
+}
+
+// Image stores the _s and _m center squares of the entry image at key,
+// e.g. image/<hash>.jpg, next to it. Keys of other blobs are skipped.
+func Image(store storage.BlobStore, key string, o imaging.Options) error {
+	return makeSizes(store, key, imageName, ".jpg", []size{{"s", ImageS}, {"m", ImageM}}, true, o)
+}
+
+// Icon stores the _s, _m and _l sizes of the icon at key next to it.
+func Icon(store storage.BlobStore, key string, o imaging.Options) error {
+	return makeSizes(store, key, iconName, ".png", []size{{"s", IconS}, {"m", IconM}, {"l", IconL}}, false, o)
+}
+
+func makeSizes(store storage.BlobStore, key string, name *regexp.Regexp, ext string, sizes []size, square bool, o imaging.Options) error {
+	m := name.FindStringSubmatch(path.Base(key))
+	if m == nil || m[2] != "" {
+		return nil
+	}
+
+	var orig image.Image
+	for _, size := range sizes {
+		target := path.Join(path.Dir(key), m[1]+"_"+size.name+ext)
+		if ok, err := store.Exists(target); err != nil {
+			return err
+		} else if ok {
+			log.Printf("%s exists", target)
+			continue
+		}
+		if orig == nil {
+			img, err := Load(store, key)
+			if err != nil {
+				return err
+			}
+			if square {
+				img = imaging.CropSquare(img)
+			}
+			orig = img
+		}
+		log.Printf("making size %s: %s", size.name, target)
+		if err := Store(store, target, imaging.Fit(orig, size.pixels, size.pixels), o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load decodes the image at key.
+func Load(store storage.BlobStore, key string) (image.Image, error) {
+	data, err := storage.ReadAll(store, key)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := imaging.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Store encodes img in the format the extension of key names.
+func Store(store storage.BlobStore, key string, img image.Image, o imaging.Options) error {
+	format := imaging.FormatOf(key)
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, format, o); err != nil {
+		return err
+	}
+	return store.Put(key, buf.Bytes(), "image/"+format)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimelinePageSize = 30
+
+	// visibleEntries is what the user in both placeholders may see: their
+	// own entries, public ones and those for followers of users they follow
+	visibleEntries = "(user=? OR publish_level=2 OR (publish_level=1 AND user IN (SELECT target FROM follow_map WHERE user=?)))"
+)
+
+type TimelineConfig struct {
+	// PollInterval in seconds makes waiters look in the database now and
+	// then too, which is only needed when several app hosts share it: the
+	// hub does not hear about entries posted on the other ones
+	PollInterval int `json:"poll_interval"`
+	// PageSize is the most entries in one response
+	PageSize int `json:"page_size"`
+	// Heartbeat is how often /timeline/stream pings an idle connection, in
+	// seconds
+	Heartbeat int `json:"heartbeat_interval"`
+	// WriteTimeout in seconds closes a stream whose client stopped reading
+	WriteTimeout int `json:"write_timeout"`
+}
+
+func (c TimelineConfig) pageSize() int {
+	if c.PageSize <= 0 {
+		return defaultTimelinePageSize
+	}
+	return c.PageSize
+}
+
+// entryEvent is a new entry and who may see it.
+type entryEvent struct {
+	Id           int
+	User         int
+	PublishLevel int
+	// Followers of User, for publish_level 1. If it is nil every
+	// subscriber is woken and checks in the database.
+	Followers map[int]bool
+}
+
+func (e *entryEvent) visibleTo(user int) bool {
+	switch {
+	case e.User == user || e.PublishLevel == 2:
+		return true
+	case e.PublishLevel == 1:
+		return e.Followers == nil || e.Followers[user]
+	}
+	return false
+}
+
+// hub tells waiting timeline requests about new entries. It has no
+// goroutines of its own: publish never blocks, and a subscription is only
+// a channel that is gone once it is unsubscribed.
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscription]bool
+}
+
+// subscription wakes up a user's waiter. Wake-ups coalesce: whoever is
+// woken reads everything after its latest entry from the database, so one
+// pending wake-up is as good as many.
+type subscription struct {
+	user int
+	wake chan struct{}
+}
+
+var timeline = newHub()
+
+func newHub() *hub {
+	return &hub{subs: make(map[*subscription]bool)}
+}
+
+func (h *hub) subscribe(user int) *subscription {
+	s := &subscription{user: user, wake: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[s] = true
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+func (h *hub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *hub) publish(e *entryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !e.visibleTo(s.user) {
+			continue
+		}
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait returns nil when an entry the subscriber may see was published,
+// and the error of ctx when it is done first.
+func (s *subscription) wait(ctx context.Context) error {
+	select {
+	case <-s.wake:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishEntry wakes the waiters that may see entry.
+func publishEntry(entry *Entry) {
+	e := &entryEvent{Id: entry.Id, User: entry.User, PublishLevel: entry.PublishLevel}
+	if entry.PublishLevel == 1 && timeline.subscribers() > 0 {
+		followers, err := loadFollowers(entry.User)
+		if err != nil {
+			log.Printf("can't load followers of %d, waking everyone: %v", entry.User, err)
+		}
+		e.Followers = followers
+	}
+	timeline.publish(e)
+}
+
+func loadFollowers(user int) (map[int]bool, error) {
+	rows, err := dbConn.Query("SELECT user FROM follow_map WHERE target = ?", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	followers := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		followers[id] = true
+	}
+	return followers, rows.Err()
+}
+
+var errTimelineCursor = errors.New("invalid timeline cursor")
+
+// timelinePage is a timeline response. NextCursor is the before of the
+// page of older entries, 0 if there are none or the page is of newer ones.
+// LatestEntry is what the client polls after next, a page of older entries
+// leaves it as the client sent it.
+type timelinePage struct {
+	Entries     []Response
+	LatestEntry int
+	NextCursor  int
+}
+
+func (p *timelinePage) response() Response {
+	r := Response{
+		"latest_entry": p.LatestEntry,
+		"entries":      p.Entries,
+		"next_cursor":  nil,
+	}
+	if 0 < p.NextCursor {
+		r["next_cursor"] = p.NextCursor
+	}
+	return r
+}
+
+// loadTimeline returns a page of the entries user may see, newest first:
+// the ones before the entry id before if it is set, else the ones after
+// latestEntryId if that is set, else the latest ones.
+func loadTimeline(baseUrl *url.URL, user *User, latestEntryId int, before int) (*timelinePage, error) {
+	pageSize := config.Timeline.pageSize()
+	var query string
+	args := []interface{}{user.Id, user.Id}
+	switch {
+	case 0 < before:
+		// one more tells whether there is another page
+		query = "SELECT * FROM entries WHERE " + visibleEntries + " AND id < ? ORDER BY id DESC LIMIT ?"
+		args = append(args, before, pageSize+1)
+	case 0 < latestEntryId:
+		query = "SELECT * FROM (SELECT * FROM entries WHERE " + visibleEntries + " AND id > ? ORDER BY id LIMIT ?) AS e ORDER BY e.id DESC"
+		args = append(args, latestEntryId, pageSize)
+	default:
+		query = "SELECT * FROM entries WHERE " + visibleEntries + " ORDER BY id DESC LIMIT ?"
+		args = append(args, pageSize+1)
+	}
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for rows.Next() {
+		entry := Entry{}
+		rows.Scan(&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	page := &timelinePage{Entries: []Response{}, LatestEntry: latestEntryId}
+	if pageSize < len(entries) {
+		entries = entries[:pageSize]
+		page.NextCursor = entries[pageSize-1].Id
+	}
+	for _, entry := range entries {
+		user := User{}
+		err = dbConn.QueryRow(
+			"SELECT * FROM users WHERE id = ?", entry.User,
+		).Scan(
+			&user.Id, &user.Name, &user.Apikey, &user.Icon,
+		)
+		if err != nil {
+			return nil, err
+		}
+		page.Entries = append(page.Entries, Response{
+			"id":            entry.Id,
+			"image":         baseUrl.String() + "/image/" + entry.Image,
+			"publish_level": entry.PublishLevel,
+			"user": Response{
+				"id":   user.Id,
+				"name": user.Name,
+				"icon": baseUrl.String() + "/icon/" + user.Icon,
+			},
+		})
+	}
+	if before == 0 && 0 < len(entries) {
+		page.LatestEntry = entries[0].Id
+	}
+	return page, nil
+}
+
+// timelineCursor reads before, or max_entry which includes the entry it
+// names, as the id that a page of older entries ends before. It is 0 if
+// neither is given.
+func timelineCursor(r *http.Request) (int, error) {
+	if v := r.FormValue("before"); v != "" {
+		before, err := strconv.Atoi(v)
+		if err != nil || before <= 0 {
+			return 0, errTimelineCursor
+		}
+		return before, nil
+	}
+	if v := r.FormValue("max_entry"); v != "" {
+		maxEntry, err := strconv.Atoi(v)
+		if err != nil || maxEntry <= 0 || maxEntry == math.MaxInt {
+			return 0, errTimelineCursor
+		}
+		return maxEntry + 1, nil
+	}
+	return 0, nil
+}
+
+// waitTimeline long-polls: it returns the entries after latestEntryId as
+// soon as there are any, or none after timeout. An error is returned only
+// if the database fails or the request is gone.
+func waitTimeline(ctx context.Context, baseUrl *url.URL, user *User, latestEntryId int) (*timelinePage, error) {
+	// subscribe before looking, or an entry posted in between is missed
+	sub := timeline.subscribe(user.Id)
+	defer timeline.unsubscribe(sub)
+
+	deadline := time.Now().Add(time.Second * timeout)
+	for {
+		page, err := loadTimeline(baseUrl, user, latestEntryId, 0)
+		if err != nil || 0 < len(page.Entries) {
+			return page, err
+		}
+		wait := deadline.Sub(time.Now())
+		if poll := time.Duration(config.Timeline.PollInterval) * time.Second; 0 < poll && poll < wait {
+			wait = poll
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		err = sub.wait(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil && !time.Now().Before(deadline) {
+			return page, nil
+		}
+	}
+}
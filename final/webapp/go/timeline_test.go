@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// timelineDB is the entries, users and follows the timeline reads, behind a
+// database/sql driver that knows only its queries. The WHERE condition of
+// an entries query is evaluated as written, see condParser, so the tests
+// check visibleEntries itself.
+type timelineDB struct {
+	mu      sync.Mutex
+	entries []Entry
+	follows []map[string]int
+}
+
+var testTimelineDB *timelineDB
+
+// useTimelineDB points dbConn at an empty timelineDB, with the default
+// config, until the test is over.
+func useTimelineDB(t *testing.T) *timelineDB {
+	oldConfig, oldConn := config, dbConn
+	t.Cleanup(func() { config, dbConn = oldConfig, oldConn })
+	config = &Config{}
+	testTimelineDB = &timelineDB{}
+	var err error
+	if dbConn, err = sql.Open("timelinetest", ""); err != nil {
+		t.Fatal(err)
+	}
+	return testTimelineDB
+}
+
+// post adds an entry and wakes the waiters like postHandler does.
+func (db *timelineDB) post(user, publishLevel int) *Entry {
+	db.mu.Lock()
+	entry := Entry{Id: len(db.entries) + 1, User: user, Image: fmt.Sprintf("img%d", len(db.entries)+1), PublishLevel: publishLevel, CreatedAt: "2013-10-05 10:00:00"}
+	db.entries = append(db.entries, entry)
+	db.mu.Unlock()
+	publishEntry(&entry)
+	return &entry
+}
+
+func (db *timelineDB) follow(user, target int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.follows = append(db.follows, map[string]int{"user": user, "target": target})
+}
+
+func apiKey(user int) string {
+	return fmt.Sprintf("key%d", user)
+}
+
+type timelineConn struct{}
+type timelineStmt struct{ query string }
+
+type timelineRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (timelineConn) Prepare(query string) (driver.Stmt, error) { return timelineStmt{query}, nil }
+func (timelineConn) Close() error                              { return nil }
+func (timelineConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s timelineStmt) Close() error  { return nil }
+func (s timelineStmt) NumInput() int { return -1 }
+
+func (s timelineStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s timelineStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := testTimelineDB
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	users := []string{"id", "name", "api_key", "icon"}
+	switch {
+	case s.query == "SELECT * FROM users WHERE id = ?":
+		id := args[0].(int64)
+		return &timelineRows{users, [][]driver.Value{{id, fmt.Sprintf("user%d", id), apiKey(int(id)), "default"}}}, nil
+	case s.query == "SELECT * FROM users WHERE api_key = ?":
+		var id int64
+		if _, err := fmt.Sscanf(args[0].(string), "key%d", &id); err != nil {
+			return &timelineRows{users, nil}, nil
+		}
+		return &timelineRows{users, [][]driver.Value{{id, fmt.Sprintf("user%d", id), args[0], "default"}}}, nil
+	case s.query == "SELECT user FROM follow_map WHERE target = ?":
+		rows := &timelineRows{columns: []string{"user"}}
+		for _, f := range db.follows {
+			if int64(f["target"]) == args[0].(int64) {
+				rows.values = append(rows.values, []driver.Value{int64(f["user"])})
+			}
+		}
+		return rows, nil
+	case s.query == "SELECT * FROM entries WHERE image = ?":
+		rows := &timelineRows{columns: []string{"id", "user", "image", "publish_level", "created_at"}}
+		for _, e := range db.entries {
+			if e.Image == args[0].(string) {
+				rows.values = append(rows.values, []driver.Value{int64(e.Id), int64(e.User), e.Image, int64(e.PublishLevel), e.CreatedAt})
+			}
+		}
+		return rows, nil
+	case strings.Contains(s.query, "FROM entries WHERE "):
+		return db.queryEntries(s.query, args)
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+// queryEntries runs the three queries of loadTimeline: its WHERE starts
+// with a condition in parentheses, then an id before or after a cursor
+// may follow, and the last placeholder is the limit.
+func (db *timelineDB) queryEntries(query string, args []driver.Value) (driver.Rows, error) {
+	where := query[strings.Index(query, "FROM entries WHERE ")+len("FROM entries WHERE "):]
+	// a row of zeros finds the errors and the placeholders of the condition
+	// even if there are no entries
+	_, used, err := db.visible(where, args, Entry{})
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", query, err)
+	}
+	var matched []Entry
+	for _, entry := range db.entries {
+		if ok, _, _ := db.visible(where, args, entry); ok {
+			matched = append(matched, entry)
+		}
+	}
+
+	rest := args[used:]
+	limit := int(rest[len(rest)-1].(int64))
+	var page []Entry
+	switch {
+	case strings.Contains(where, " AND id < ? ORDER BY id DESC LIMIT ?"):
+		for i := len(matched) - 1; 0 <= i && len(page) < limit; i-- {
+			if matched[i].Id < int(rest[0].(int64)) {
+				page = append(page, matched[i])
+			}
+		}
+	case strings.Contains(where, " AND id > ? ORDER BY id LIMIT ?) AS e ORDER BY e.id DESC"):
+		for _, entry := range matched {
+			if entry.Id > int(rest[0].(int64)) && len(page) < limit {
+				page = append([]Entry{entry}, page...)
+			}
+		}
+	case strings.HasSuffix(where, ") ORDER BY id DESC LIMIT ?"):
+		for i := len(matched) - 1; 0 <= i && len(page) < limit; i-- {
+			page = append(page, matched[i])
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	rows := &timelineRows{columns: []string{"id", "user", "image", "publish_level", "created_at"}}
+	for _, e := range page {
+		rows.values = append(rows.values, []driver.Value{int64(e.Id), int64(e.User), e.Image, int64(e.PublishLevel), e.CreatedAt})
+	}
+	return rows, nil
+}
+
+// visible evaluates the condition in parentheses where starts with for
+// entry, and tells how many args it takes.
+func (db *timelineDB) visible(where string, args []driver.Value, entry Entry) (bool, int, error) {
+	p := &condParser{
+		tokens:  sqlToken.FindAllString(where, -1),
+		args:    args,
+		row:     map[string]int{"id": entry.Id, "user": entry.User, "publish_level": entry.PublishLevel},
+		follows: db.follows,
+	}
+	if p.peek() != "(" {
+		return false, 0, errors.New("the condition is not in parentheses")
+	}
+	v := p.term()
+	return v, p.used, p.err
+}
+
+var (
+	sqlToken      = regexp.MustCompile(`[()=?<>*.]|\w+`)
+	followColumns = map[string]int{"user": 0, "target": 0}
+)
+
+// condParser evaluates a condition made of col=value, AND, OR, parentheses
+// and col IN (SELECT col FROM follow_map WHERE col=value) for one row.
+// Placeholders take the args in order, used counts them.
+type condParser struct {
+	tokens  []string
+	args    []driver.Value
+	used    int
+	row     map[string]int
+	follows []map[string]int
+	err     error
+}
+
+func (p *condParser) fail(format string, a ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (p *condParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *condParser) next() string {
+	t := p.peek()
+	if t == "" {
+		p.fail("unexpected end of the condition")
+		return ""
+	}
+	p.tokens = p.tokens[1:]
+	return t
+}
+
+func (p *condParser) expect(want string) {
+	if t := p.next(); t != want {
+		p.fail("got %q, want %q", t, want)
+	}
+}
+
+func (p *condParser) or() bool {
+	v := p.and()
+	for p.peek() == "OR" {
+		p.next()
+		w := p.and()
+		v = v || w
+	}
+	return v
+}
+
+func (p *condParser) and() bool {
+	v := p.term()
+	for p.peek() == "AND" {
+		p.next()
+		w := p.term()
+		v = v && w
+	}
+	return v
+}
+
+func (p *condParser) term() bool {
+	if p.peek() == "(" {
+		p.next()
+		v := p.or()
+		p.expect(")")
+		return v
+	}
+	col := p.column(p.row)
+	if p.peek() != "IN" {
+		p.expect("=")
+		return p.row[col] == p.value()
+	}
+	p.next()
+	p.expect("(")
+	p.expect("SELECT")
+	selected := p.column(followColumns)
+	p.expect("FROM")
+	p.expect("follow_map")
+	p.expect("WHERE")
+	where := p.column(followColumns)
+	p.expect("=")
+	v := p.value()
+	p.expect(")")
+	for _, f := range p.follows {
+		if f[where] == v && f[selected] == p.row[col] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *condParser) column(row map[string]int) string {
+	col := p.next()
+	if _, ok := row[col]; !ok {
+		p.fail("no column %q", col)
+	}
+	return col
+}
+
+func (p *condParser) value() int {
+	t := p.next()
+	if t != "?" {
+		n, err := strconv.Atoi(t)
+		if err != nil {
+			p.fail("bad value %q", t)
+		}
+		return n
+	}
+	if len(p.args) <= p.used {
+		p.fail("too few args")
+		return 0
+	}
+	p.used++
+	return int(p.args[p.used-1].(int64))
+}
+
+func (r *timelineRows) Columns() []string { return r.columns }
+func (r *timelineRows) Close() error      { return nil }
+
+func (r *timelineRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+type timelineDriver struct{}
+
+func (timelineDriver) Open(name string) (driver.Conn, error) { return timelineConn{}, nil }
+
+func init() {
+	sql.Register("timelinetest", timelineDriver{})
+}
+
+func woken(s *subscription) bool {
+	select {
+	case <-s.wake:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubWakesVisibleSubscribers(t *testing.T) {
+	h := newHub()
+	owner, follower, other := h.subscribe(1), h.subscribe(2), h.subscribe(3)
+	defer h.unsubscribe(owner)
+	defer h.unsubscribe(follower)
+	defer h.unsubscribe(other)
+
+	tests := []struct {
+		event *entryEvent
+		want  [3]bool
+	}{
+		{&entryEvent{User: 1, PublishLevel: 0}, [3]bool{true, false, false}},
+		{&entryEvent{User: 1, PublishLevel: 1, Followers: map[int]bool{2: true}}, [3]bool{true, true, false}},
+		{&entryEvent{User: 1, PublishLevel: 1}, [3]bool{true, true, true}},
+		{&entryEvent{User: 1, PublishLevel: 2}, [3]bool{true, true, true}},
+	}
+	for i, test := range tests {
+		h.publish(test.event)
+		got := [3]bool{woken(owner), woken(follower), woken(other)}
+		if got != test.want {
+			t.Errorf("%d: woken = %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestHubPublishNeverBlocks(t *testing.T) {
+	h := newHub()
+	s := h.subscribe(1)
+	defer h.unsubscribe(s)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			h.publish(&entryEvent{User: 1})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a subscriber that does not read")
+	}
+	if !woken(s) || woken(s) {
+		t.Error("want exactly one coalesced wake-up")
+	}
+}
+
+func TestSubscriptionWait(t *testing.T) {
+	h := newHub()
+	s := h.subscribe(1)
+	defer h.unsubscribe(s)
+	go h.publish(&entryEvent{User: 2, PublishLevel: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.wait(ctx); err != nil {
+		t.Fatalf("wait = %v, want a wake-up", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestWaitersDoNotLeak cancels many waiting requests and checks that their
+// goroutines and subscriptions are all gone.
+func TestWaitersDoNotLeak(t *testing.T) {
+	h := newHub()
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(user int) {
+			defer wg.Done()
+			s := h.subscribe(user)
+			defer h.unsubscribe(s)
+			s.wait(ctx)
+		}(i)
+	}
+	for h.subscribers() < 100 {
+		runtime.Gosched()
+	}
+	// entries nobody may see wake nobody
+	h.publish(&entryEvent{User: -1, PublishLevel: 0})
+	cancel()
+	wg.Wait()
+
+	if n := h.subscribers(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines before, %d after", before, n)
+	}
+}
+
+func TestTimelineCursor(t *testing.T) {
+	tests := []struct {
+		query  string
+		before int
+		err    error
+	}{
+		{"", 0, nil},
+		{"latest_entry=5", 0, nil},
+		{"before=5", 5, nil},
+		{"max_entry=5", 6, nil},
+		// before wins
+		{"before=3&max_entry=9", 3, nil},
+		{"max_entry=" + strconv.Itoa(math.MaxInt-1), math.MaxInt, nil},
+		{"max_entry=" + strconv.Itoa(math.MaxInt), 0, errTimelineCursor},
+		{"max_entry=99999999999999999999", 0, errTimelineCursor},
+		{"max_entry=0", 0, errTimelineCursor},
+		{"max_entry=x", 0, errTimelineCursor},
+		{"before=0", 0, errTimelineCursor},
+		{"before=-1", 0, errTimelineCursor},
+		{"before=1.5", 0, errTimelineCursor},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/timeline?"+test.query, nil)
+		before, err := timelineCursor(r)
+		if before != test.before || err != test.err {
+			t.Errorf("%s: got %d, %v, want %d, %v", test.query, before, err, test.before, test.err)
+		}
+	}
+}
+
+func pageIds(page *timelinePage) []int {
+	ids := []int{}
+	for _, e := range page.Entries {
+		ids = append(ids, e["id"].(int))
+	}
+	return ids
+}
+
+func TestLoadTimelinePages(t *testing.T) {
+	db := useTimelineDB(t)
+	config.Timeline.PageSize = 3
+	for i := 0; i < 7; i++ {
+		db.post(1, 2)
+	}
+	tests := []struct {
+		latestEntry, before int
+		ids                 []int
+		wantLatest          int
+		nextCursor          int
+	}{
+		{0, 0, []int{7, 6, 5}, 7, 5},
+		{0, 5, []int{4, 3, 2}, 0, 2},
+		// a page of older entries leaves latest_entry as the client sent it
+		{7, 5, []int{4, 3, 2}, 7, 2},
+		{7, 2, []int{1}, 7, 0},
+		{7, 1, []int{}, 7, 0},
+		// exactly a page is left: no cursor to an empty one
+		{7, 4, []int{3, 2, 1}, 7, 0},
+		// newer entries come closest to latest_entry first and have no cursor
+		{2, 0, []int{5, 4, 3}, 5, 0},
+		{5, 0, []int{7, 6}, 7, 0},
+		{7, 0, []int{}, 7, 0},
+	}
+	for _, test := range tests {
+		page, err := loadTimeline(&url.URL{}, &User{Id: 1}, test.latestEntry, test.before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := pageIds(page); fmt.Sprint(ids) != fmt.Sprint(test.ids) || page.LatestEntry != test.wantLatest || page.NextCursor != test.nextCursor {
+			t.Errorf("latest_entry %d, before %d: got %v, latest %d, cursor %d, want %v, %d, %d",
+				test.latestEntry, test.before, ids, page.LatestEntry, page.NextCursor, test.ids, test.wantLatest, test.nextCursor)
+		}
+	}
+
+	page, _ := loadTimeline(&url.URL{}, &User{Id: 1}, 0, 0)
+	if r := page.response(); r["next_cursor"] != 5 || r["latest_entry"] != 7 {
+		t.Errorf("response %v", r)
+	}
+	page, _ = loadTimeline(&url.URL{}, &User{Id: 1}, 0, 2)
+	if r := page.response(); r["next_cursor"] != nil {
+		t.Errorf("next_cursor of the last page is %v, want null", r["next_cursor"])
+	}
+}
+
+func after(ids []int, id int) []int {
+	newer := []int{}
+	for _, i := range ids {
+		if i > id {
+			newer = append(newer, i)
+		}
+	}
+	return newer
+}
+
+func TestLoadTimelineVisibility(t *testing.T) {
+	db := useTimelineDB(t)
+	// 1 follows 2, 3 follows 1
+	db.follow(1, 2)
+	db.follow(3, 1)
+	db.post(1, 0) // 1
+	db.post(1, 1) // 2
+	db.post(2, 0) // 3
+	db.post(2, 1) // 4
+	db.post(2, 2) // 5
+	db.post(3, 0) // 6
+	db.post(3, 1) // 7
+	db.post(3, 2) // 8
+	for user, want := range map[int][]int{
+		1: {8, 5, 4, 2, 1},
+		2: {8, 5, 4, 3},
+		3: {8, 7, 6, 5, 2},
+		4: {8, 5},
+	} {
+		page, err := loadTimeline(&url.URL{}, &User{Id: user}, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := pageIds(page); fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("user %d sees %v, want %v", user, ids, want)
+		}
+		// older pages and newer ones go by the same rule
+		page, _ = loadTimeline(&url.URL{}, &User{Id: user}, 0, 9)
+		if ids := pageIds(page); fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("user %d sees %v before 9, want %v", user, ids, want)
+		}
+		page, _ = loadTimeline(&url.URL{}, &User{Id: user}, 1, 0)
+		if ids := pageIds(page); fmt.Sprint(ids) != fmt.Sprint(after(want, 1)) {
+			t.Errorf("user %d sees %v after 1, want %v", user, ids, after(want, 1))
+		}
+	}
+}
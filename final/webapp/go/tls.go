@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+const listenTLSAddr = ":5443"
+
+type TLSConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Listen       string `json:"listen"`
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	SelfSigned   bool   `json:"self_signed"`
+	RedirectFrom string `json:"redirect_from"`
+}
+
+// listenAndServe serves plain HTTP on listenAddr, or HTTPS with HTTP/2
+// when TLS is enabled. In TLS mode an optional plain listener redirects
+// everything to the HTTPS one.
+func listenAndServe(c TLSConfig, handler http.Handler) error {
+	if !c.Enabled {
+		return http.ListenAndServe(listenAddr, handler)
+	}
+	addr := c.Listen
+	if addr == "" {
+		addr = listenTLSAddr
+	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+	switch {
+	case c.CertFile != "" && c.KeyFile != "":
+	case c.SelfSigned:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return err
+		}
+		log.Printf("using a self-signed certificate, do not use this in production")
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+	default:
+		return errors.New("tls: cert_file and key_file, or self_signed, are required")
+	}
+	if c.RedirectFrom != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(c.RedirectFrom, httpsRedirectHandler(addr)))
+		}()
+	}
+	log.Printf("listening on %s (https)", addr)
+	return server.ListenAndServeTLS(c.CertFile, c.KeyFile)
+}
+
+func httpsRedirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"isucon3 development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"./imaging"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	defaultUploadMaxBytes  = 10 << 20
+	defaultUploadMaxWidth  = 8192
+	defaultUploadMaxHeight = 8192
+	defaultUploadMaxPixels = 40000000
+
+	// room for the multipart boundaries and the other form fields
+	multipartOverhead = 64 << 10
+)
+
+type UploadConfig struct {
+	MaxBytes int64 `json:"max_bytes"`
+	imaging.Limits
+	// KeepMetadata stores uploaded photos with their EXIF data as they are
+	KeepMetadata bool `json:"keep_metadata"`
+}
+
+func (c UploadConfig) maxBytes() int64 {
+	if c.MaxBytes <= 0 {
+		return defaultUploadMaxBytes
+	}
+	return c.MaxBytes
+}
+
+func (c UploadConfig) limits() imaging.Limits {
+	l := c.Limits
+	if l.MaxWidth == 0 {
+		l.MaxWidth = defaultUploadMaxWidth
+	}
+	if l.MaxHeight == 0 {
+		l.MaxHeight = defaultUploadMaxHeight
+	}
+	if l.MaxPixels == 0 {
+		l.MaxPixels = defaultUploadMaxPixels
+	}
+	return l
+}
+
+// uploadError is a rejected upload, reported to the client as JSON with
+// its status.
+type uploadError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+func renderUploadError(w http.ResponseWriter, e *uploadError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	fmt.Fprint(w, Response{"error": Response{"code": e.code, "message": e.message}})
+}
+
+// readUpload reads the image in the form field and checks it by its
+// content: the magic bytes must be one of formats, the dimensions within
+// the limits, and the whole image must decode. It returns the bytes as
+// uploaded together with the decoded image and its format.
+func readUpload(w http.ResponseWriter, r *http.Request, field string, formats ...string) ([]byte, image.Image, string, *uploadError) {
+	maxBytes := config.Upload.maxBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+multipartOverhead)
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, "", tooLargeError(maxBytes)
+		}
+		return nil, nil, "", &uploadError{http.StatusBadRequest, "missing_file", fmt.Sprintf("no file in the %s field", field)}
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return nil, nil, "", &uploadError{http.StatusBadRequest, "read_failed", "the upload could not be read"}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, nil, "", tooLargeError(maxBytes)
+	}
+
+	format := imaging.Sniff(data)
+	if !containsString(formats, format) {
+		return nil, nil, "", &uploadError{http.StatusUnsupportedMediaType, "unsupported_type", fmt.Sprintf("the file is not one of %v", formats)}
+	}
+	img, _, err := imaging.DecodeLimited(data, config.Upload.limits())
+	if err == imaging.ErrDimensions {
+		l := config.Upload.limits()
+		return nil, nil, "", &uploadError{http.StatusUnprocessableEntity, "too_many_pixels",
+			fmt.Sprintf("images may be at most %dx%d and %d pixels", l.MaxWidth, l.MaxHeight, l.MaxPixels)}
+	}
+	if err != nil {
+		return nil, nil, "", &uploadError{http.StatusUnprocessableEntity, "invalid_image", "the image could not be decoded"}
+	}
+	return data, img, format, nil
+}
+
+func tooLargeError(maxBytes int64) *uploadError {
+	return &uploadError{http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("files may be at most %d bytes", maxBytes)}
+}
+
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
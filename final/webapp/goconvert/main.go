@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
@@ -12,7 +13,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"sync"
@@ -21,26 +21,25 @@ import (
 	"code.google.com/p/go-uuid/uuid"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+
+	"../go/imaging"
+	"../go/storage"
+	"../go/thumbnail"
 )
 
 const (
 	listenAddr = ":5000"
-	tmpDir     = "/tmp/"
 
 	timeout  = 30
 	interval = 2
 
-	iconS  = 32
-	iconM  = 64
-	iconL  = 128
-	imageS = 128
-	imageM = 256
 	imageL = -1
 )
 
 var (
 	dbConn *sql.DB
 	config *Config
+	blobs  storage.BlobStore
 )
 
 type Config struct {
@@ -51,7 +50,8 @@ type Config struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"database"`
-	Datadir string `json:"data_dir"`
+	Datadir string         `json:"data_dir"`
+	Storage storage.Config `json:"storage"`
 }
 
 type User struct {
@@ -137,24 +137,40 @@ func loadConfig(filename string) *Config {
 	return &config
 }
 
+var configFile = flag.String("config", "", "config file of the app whose storage to convert images and icons in")
 var imgconvdir = flag.String("imgconvdir", "", "directory to convert images")
 var iconconvdir = flag.String("iconconvdir", "", "directory to convert images")
+var quality = flag.Int("quality", imaging.DefaultQuality, "JPEG quality of the thumbnails")
+
+var options imaging.Options
 
 func main() {
 	flag.Parse()
+	options.Quality = *quality
+	if *configFile != "" {
+		config = loadConfig(*configFile)
+		var err error
+		blobs, err = storage.New(config.Storage, config.Datadir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("convert images and icons in the storage of %s", *configFile)
+		convertImages(blobs, "image/")
+		convertIcons(blobs, "icon/")
+	}
 	if *imgconvdir != "" {
 		log.Printf("convert image in directory %s", *imgconvdir)
-		convertImages(*imgconvdir)
+		convertImages(storage.NewLocal(*imgconvdir), "")
 	}
 	if *iconconvdir != "" {
 		log.Printf("convert icons in directory %s", *iconconvdir)
-		convertIcons(*iconconvdir)
+		convertIcons(storage.NewLocal(*iconconvdir), "")
 	}
 	log.Printf("done")
 }
 
-func convertImages(imgDir string) {
-	files, err := ioutil.ReadDir(imgDir)
+func convertImages(store storage.BlobStore, prefix string) {
+	blobs, err := store.List(prefix)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -170,20 +186,22 @@ func convertImages(imgDir string) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for name := range ch {
-				makeImageThumbnails(imgDir, name)
+			for key := range ch {
+				if err := thumbnail.Image(store, key, options); err != nil {
+					log.Printf("%s: %v", key, err)
+				}
 			}
 		}()
 	}
 
-	for _, f := range files {
-		ch <- f.Name()
+	for _, b := range blobs {
+		ch <- b.Key
 	}
 	close(ch)
 }
 
-func convertIcons(imgDir string) {
-	files, err := ioutil.ReadDir(imgDir)
+func convertIcons(store storage.BlobStore, prefix string) {
+	blobs, err := store.List(prefix)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -199,14 +217,16 @@ func convertIcons(imgDir string) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for name := range ch {
-				makeIconThumbnails(imgDir, name)
+			for key := range ch {
+				if err := thumbnail.Icon(store, key, options); err != nil {
+					log.Printf("%s: %v", key, err)
+				}
 			}
 		}()
 	}
 
-	for _, f := range files {
-		ch <- f.Name()
+	for _, b := range blobs {
+		ch <- b.Key
 	}
 	close(ch)
 }
@@ -242,74 +262,21 @@ func sha256Hex(a ...interface{}) string {
 	return hex.EncodeToString(md)
 }
 
-func convert(path string, ext string, w int, h int) ([]byte, error) {
-	f, err := ioutil.TempFile(tmpDir, "isucon")
+// encodeThumbnail decodes the image at key, crops it to its center square if
+// square is set, and encodes it fitted into w x h as format.
+func encodeThumbnail(key string, square bool, w int, h int, format string) ([]byte, error) {
+	img, err := thumbnail.Load(blobs, key)
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(f.Name())
-
-	newFile := fmt.Sprintf("%s.%s", f.Name(), ext)
-
-	cmd := exec.Command("convert", "-geometry", fmt.Sprintf("%dx%d", w, h), path, newFile)
-	if err := cmd.Run(); err != nil {
-		return nil, err
+	if square {
+		img = imaging.CropSquare(img)
 	}
-	defer os.Remove(newFile)
-
-	b, err := ioutil.ReadFile(newFile)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, imaging.Fit(img, w, h), format, options); err != nil {
 		return nil, err
 	}
-
-	return b, nil
-}
-
-func resizeToFile(path string, ext string, suffix string, w int, h int) {
-	newFile := fmt.Sprintf("%s.%s.%s", path, suffix, ext)
-	cmd := exec.Command("convert", "-geometry", fmt.Sprintf("%dx%d", w, h), path, newFile)
-	if err := cmd.Run(); err != nil {
-		panic(err.Error())
-	}
-}
-
-func cropSquare(orig string, ext string) (string, error) {
-	str, err := exec.Command("identify", orig).Output()
-	if err != nil {
-		return "", err
-	}
-	size := regexp.MustCompile(" +").Split(string(str), 4)[2]
-	wh := regexp.MustCompile("x").Split(size, 2)
-	w, _ := strconv.Atoi(wh[0])
-	h, _ := strconv.Atoi(wh[1])
-	var crop_x float32
-	var crop_y float32
-	var pixels int
-	if w > h {
-		pixels = h
-		crop_x = (float32(w-pixels) / 2)
-		crop_y = 0
-	} else if w < h {
-		pixels = w
-		crop_x = 0
-		crop_y = (float32(h-pixels) / 2)
-	} else {
-		pixels = w
-		crop_x = 0
-		crop_y = 0
-	}
-	f, err := ioutil.TempFile(tmpDir, "isucon")
-	if err != nil {
-		return "", err
-	}
-	os.Remove(f.Name())
-
-	newFile := fmt.Sprintf("%s.%s", f.Name(), ext)
-	cmd := exec.Command("convert", "-crop", fmt.Sprintf("%vx%v+%v+%v", pixels, pixels, crop_x, crop_y), orig, newFile)
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-	return newFile, nil
+	return buf.Bytes(), nil
 }
 
 func renderJson(w http.ResponseWriter, r Response) {
@@ -420,7 +387,7 @@ func entryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	imageId := sha256Hex(uuid.NewUUID())
-	err = ioutil.WriteFile(config.Datadir+"/image/"+imageId+".jpg", data, 0666)
+	err = blobs.Put("image/"+imageId+".jpg", data, "image/jpeg")
 	if err != nil {
 		serverError(w, err)
 		return
@@ -573,7 +540,10 @@ func iconHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	icon := vars["icon"]
 
-	if _, err := os.Stat(config.Datadir + "/icon/" + icon + ".png"); os.IsNotExist(err) {
+	if ok, err := blobs.Exists("icon/" + icon + ".png"); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
 		notFound(w)
 		return
 	}
@@ -586,17 +556,17 @@ func iconHandler(w http.ResponseWriter, r *http.Request) {
 	var width int
 	var height int
 	if size == "s" {
-		width = iconS
+		width = thumbnail.IconS
 	} else if size == "m" {
-		width = iconM
+		width = thumbnail.IconM
 	} else if size == "l" {
-		width = iconL
+		width = thumbnail.IconL
 	} else {
-		width = iconS
+		width = thumbnail.IconS
 	}
 	height = width
 
-	data, err := convert(config.Datadir+"/icon/"+icon+".png", "png", width, height)
+	data, err := encodeThumbnail("icon/"+icon+".png", false, width, height, "png")
 	if err != nil {
 		serverError(w, err)
 		return
@@ -671,9 +641,9 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 
 	var width, height int
 	if size == "s" {
-		width = imageS
+		width = thumbnail.ImageS
 	} else if size == "m" {
-		width = imageM
+		width = thumbnail.ImageM
 	} else if size == "l" {
 		width = imageL
 	} else {
@@ -683,20 +653,14 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 
 	var data []byte
 	if 0 <= width {
-		path, err := cropSquare(config.Datadir+"/image/"+image+".jpg", "jpg")
-		defer os.Remove(path)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
-		b, err := convert(path, "jpg", width, height)
+		b, err := encodeThumbnail("image/"+image+".jpg", true, width, height, "jpeg")
 		if err != nil {
 			serverError(w, err)
 			return
 		}
 		data = b
 	} else {
-		b, err := ioutil.ReadFile(config.Datadir + "/image/" + image + ".jpg")
+		b, err := storage.ReadAll(blobs, "image/"+image+".jpg")
 		if err != nil {
 			serverError(w, err)
 			return
@@ -708,78 +672,6 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func convertImage(orig string, target string, w int, h int) {
-	cmd := exec.Command("convert", "-quality", "70", "-define", fmt.Sprintf("jpeg:size=%dx%d", w, h), "-geometry", fmt.Sprintf("%dx%d", w, h), orig, target)
-	if err := cmd.Run(); err != nil {
-		panic(err.Error())
-	}
-}
-
-func makeImageThumbnails(dir string, name string) {
-	m := regexp.MustCompile("^([0-9a-f]+)(_(?:s|m|l))?.jpg$").FindStringSubmatch(name)
-	if m == nil {
-		return
-	}
-	if m[2] != "" {
-		return
-	}
-
-	hash := m[1]
-	sizes := []string{"s", "m"}
-	for _, size := range sizes {
-		target := fmt.Sprintf("%s/%s_%s.jpg", dir, hash, size)
-		if FileExists(target) {
-			log.Printf("%s exists", target)
-			continue
-		}
-		orig := fmt.Sprintf("%s/%s", dir, name)
-		square, err := cropSquare(orig, "jpg")
-		if err != nil {
-			panic(err.Error())
-		}
-		switch size {
-		case "s":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(square, target, imageS, imageS)
-		case "m":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(square, target, imageM, imageM)
-		}
-	}
-}
-
-func makeIconThumbnails(dir string, name string) {
-	m := regexp.MustCompile("^([0-9a-z]+)(_(?:s|m|l))?.png$").FindStringSubmatch(name)
-	if m == nil {
-		return
-	}
-	if m[2] != "" {
-		return
-	}
-
-	hash := m[1]
-	sizes := []string{"s", "m", "l"}
-	for _, size := range sizes {
-		target := fmt.Sprintf("%s/%s_%s.png", dir, hash, size)
-		if FileExists(target) {
-			log.Printf("%s exists", target)
-			continue
-		}
-		orig := fmt.Sprintf("%s/%s", dir, name)
-		switch size {
-		case "s":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(orig, target, iconS, iconS)
-		case "m":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(orig, target, iconM, iconM)
-		case "l":
-			log.Printf("making size %s: %s", size, target)
-			convertImage(orig, target, iconL, iconL)
-		}
-	}
-}
-
 func FileExists(name string) bool {
 	_, err := os.Stat(name)
 	return !os.IsNotExist(err)
@@ -970,40 +862,14 @@ func updateIconHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := ioutil.ReadAll(uploadFile)
+	img, _, err := imaging.Decode(uploadFile)
 	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	f, err := ioutil.TempFile(tmpDir, "isucon")
-	defer os.Remove(f.Name())
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	err = ioutil.WriteFile(f.Name(), data, 0666)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	path, err := cropSquare(f.Name(), "png")
-	defer os.Remove(path)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-
-	data, err = ioutil.ReadFile(path)
-	if err != nil {
-		serverError(w, err)
+		badRequest(w)
 		return
 	}
 
 	iconId := sha256Hex(uuid.NewUUID())
-	err = ioutil.WriteFile(config.Datadir+"/icon/"+iconId+".png", data, 0666)
+	err = thumbnail.Store(blobs, "icon/"+iconId+".png", imaging.CropSquare(img), options)
 	if err != nil {
 		serverError(w, err)
 		return
@@ -32,6 +32,32 @@ const (
 )
 
 var AccessLog = false
+
+// Locale is sent as Accept-Language when set, and the pages are then
+// checked for the texts of that locale in Messages.
+var Locale = ""
+var Messages = map[string]map[string]string{
+	"en": {
+		"hello":   "Hello",
+		"signout": "SignOut",
+		"signin":  "SignIn",
+		"private": "Private",
+	},
+	"ja": {
+		"hello":   "こんにちは",
+		"signout": "サインアウト",
+		"signin":  "サインイン",
+		"private": "非公開",
+	},
+}
+
+func message(key string) string {
+	if m, ok := Messages[Locale]; ok {
+		return m[key]
+	}
+	return Messages["en"][key]
+}
+
 var StaticFiles = map[string]string{
 	"/css/bootstrap-responsive.min.css": "f889adb0886162aa4ceab5ff6338d888",
 	"/css/bootstrap.min.css":            "4082271c7f87b09c7701ffe554e61edd",
@@ -106,6 +132,9 @@ func debugLog(s string, v ...interface{}) {
 func (c *Client) requestWithTimeout(req *http.Request, f func(r *http.Response, e error)) (resp *http.Response, err error) {
 	ch := make(chan bool)
 	req.Header.Add("User-Agent", UserAgent)
+	if Locale != "" {
+		req.Header.Set("Accept-Language", Locale)
+	}
 	debugLog("client:%d\tmethod:%s\turi:%s", c.Id, req.Method, req.URL)
 	start := time.Now()
 	go func() {
@@ -151,6 +180,9 @@ func (c *Client) initClient() {
 				c.SleepAfterRedirect = 0
 			}
 			req.Header.Add("User-Agent", UserAgent)
+			if Locale != "" {
+				req.Header.Set("Accept-Language", Locale)
+			}
 			return nil
 		},
 	}
@@ -409,7 +441,7 @@ func (c *Client) mypageHandler(resp *http.Response, err error) {
 		c.Success(1.0)
 		return
 	}
-	c.matchDocNode(doc, "//h2/text()", "Hello\\s+"+*c.Username+"\\!")
+	c.matchDocNode(doc, "//h2/text()", message("hello")+"\\s+"+*c.Username+"\\!")
 	nodes, nodeerr := doc.Search("//div[contains(concat(' ', @class, ' '), ' container ')]/ul/li/a")
 	if nodeerr != nil {
 		c.Fail("li element search error")
@@ -450,16 +482,16 @@ func (c *Client) memoHandler(resp *http.Response, err error) {
 	xpath := "//h2/text()"
 	var str string
 	if c.Username != nil {
-		str = "Hello\\s+" + *c.Username + "\\!"
+		str = message("hello") + "\\s+" + *c.Username + "\\!"
 	} else {
-		str = "Hello\\s+\\!"
+		str = message("hello") + "\\s+\\!"
 	}
 	doc := c.matchHtmlNode(html, xpath, str)
 
 	if c.Username != nil {
-		c.matchDocNode(doc, "//input[@value='SignOut' and @type='submit']", "SignOut")
+		c.matchDocNode(doc, "//input[@value='"+message("signout")+"' and @type='submit']", message("signout"))
 	} else {
-		c.matchDocNode(doc, "//ul[contains(concat(' ', @class, ' '), ' nav ')]", "SignIn")
+		c.matchDocNode(doc, "//ul[contains(concat(' ', @class, ' '), ' nav ')]", message("signin"))
 	}
 
 	nodes, _ := doc.Search("//link[@href='/']")
@@ -593,7 +625,7 @@ func (c *Client) postMemoHandler(resp *http.Response, err error, title string, i
 	var expectedStatus int
 	if isprivate == 1 {
 		expectedStatus = 404
-		matched, _ := regexp.MatchString("Private", nodes[0].String())
+		matched, _ := regexp.MatchString(message("private"), nodes[0].String())
 		if !matched {
 			c.Fail("not private")
 		}
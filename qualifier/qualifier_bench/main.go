@@ -198,6 +198,7 @@ func main() {
 		var testEndpoint *string = flag.String("endpoint", endpoint, "debugging endpoint")
 		var testSeconds *int = flag.Int("seconds", 60, "running seconds")
 		var accessLog *bool = flag.Bool("accesslog", false, "show access log")
+		var locale *string = flag.String("locale", "", "Accept-Language to send, e.g. ja")
 		if DEBUG {
 			os.Args = flag.Args()
 			flag.Parse()
@@ -206,14 +207,17 @@ func main() {
 		endpoint = *testEndpoint
 		seconds  = *testSeconds
 		bench.AccessLog = *accessLog
+		bench.Locale = *locale
 		log.Println("test mode")
 		result := runBenchmark(workload)
 		showResult(result)
 	} else if command == "benchmark" {
 		var workload *int = flag.Int("workload", 1, "benchmark workload")
 		var initScript *string = flag.String("init", "", "init script")
+		var locale *string = flag.String("locale", "", "Accept-Language to send, e.g. ja")
 		os.Args = flag.Args()
 		flag.Parse()
+		bench.Locale = *locale
 		if *workload < 1 {
 			*workload = 1
 		}
@@ -16,6 +16,72 @@ CREATE TABLE `users` (
   `password` varchar(255) NOT NULL,
   `salt` varchar(255) NOT NULL,
   `last_access` datetime,
+  `is_admin` tinyint(4) NOT NULL DEFAULT '0',
+  `is_disabled` tinyint(4) NOT NULL DEFAULT '0',
+  `must_reset_password` tinyint(4) NOT NULL DEFAULT '0',
+  `locale` varchar(8) NOT NULL DEFAULT '',
   PRIMARY KEY (`id`),
   UNIQUE KEY `users_username_idx` (`username`)
 ) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `login_failures`;
+CREATE TABLE `login_failures` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user` int(11) NOT NULL,
+  `ip` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `login_failures_user_idx` (`user`, `created_at`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `memo_readers`;
+CREATE TABLE `memo_readers` (
+  `memo` int(11) NOT NULL,
+  `user` int(11) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`memo`, `user`),
+  KEY `memo_readers_user_idx` (`user`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `memo_shares`;
+CREATE TABLE `memo_shares` (
+  `memo` int(11) NOT NULL,
+  `token` varchar(64) NOT NULL,
+  PRIMARY KEY (`memo`),
+  UNIQUE KEY `memo_shares_token_idx` (`token`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `memo_files`;
+CREATE TABLE `memo_files` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `memo` int(11) NOT NULL,
+  `name` varchar(128) NOT NULL,
+  `content_type` varchar(128) NOT NULL,
+  `size` bigint(20) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `memo_files_memo_name_idx` (`memo`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `hidden_memos`;
+CREATE TABLE `hidden_memos` (
+  `memo` int(11) NOT NULL,
+  `admin` int(11) NOT NULL,
+  `reason` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`memo`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+DROP TABLE IF EXISTS `admin_audit_log`;
+CREATE TABLE `admin_audit_log` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `admin` int(11) NOT NULL,
+  `action` varchar(32) NOT NULL,
+  `target_type` varchar(32) NOT NULL,
+  `target_id` int(11) NOT NULL,
+  `detail` varchar(255) NOT NULL DEFAULT '',
+  `ip` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `admin_audit_log_target_idx` (`target_type`, `target_id`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
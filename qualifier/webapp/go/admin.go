@@ -0,0 +1,423 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	adminUsersPerPage = 50
+	adminMemosPerPage = 50
+	auditEntriesShown = 50
+)
+
+// admin actions recorded in admin_audit_log.action
+const (
+	auditDisableUser   = "disable_user"
+	auditEnableUser    = "enable_user"
+	auditResetPassword = "reset_password"
+	auditHideMemo      = "hide_memo"
+	auditUnhideMemo    = "unhide_memo"
+)
+
+type SiteStats struct {
+	Users            int
+	AdminUsers       int
+	DisabledUsers    int
+	Memos            int
+	PublicMemos      int
+	PrivateMemos     int
+	UnlistedMemos    int
+	HiddenMemos      int
+	LoginFailuresDay int
+}
+
+type AuditEntry struct {
+	Id         int
+	Admin      string
+	Action     string
+	TargetType string
+	TargetId   int
+	Detail     string
+	Ip         string
+	CreatedAt  string
+}
+
+type AdminUser struct {
+	User
+	Memos int
+}
+
+// requireAdmin answers 404 to anyone but admins, so the admin area does not
+// show up for regular users.
+func requireAdmin(w http.ResponseWriter, user *User) bool {
+	if user == nil || !user.IsAdmin {
+		notFound(w)
+		return false
+	}
+	return true
+}
+
+func audit(dbConn *sql.DB, r *http.Request, admin *User, action string, targetType string, targetId int, detail string) error {
+	_, err := dbConn.Exec(
+		"INSERT INTO admin_audit_log (admin, action, target_type, target_id, detail, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, now())",
+		admin.Id, action, targetType, targetId, detail, clientIP(r),
+	)
+	return err
+}
+
+func loadSiteStats(dbConn *sql.DB) (*SiteStats, error) {
+	stats := &SiteStats{}
+	err := dbConn.QueryRow(
+		"SELECT count(*), COALESCE(SUM(is_admin), 0), COALESCE(SUM(is_disabled), 0) FROM users",
+	).Scan(&stats.Users, &stats.AdminUsers, &stats.DisabledUsers)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := dbConn.Query("SELECT is_private, count(*) FROM memos GROUP BY is_private")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var visibility, n int
+		rows.Scan(&visibility, &n)
+		stats.Memos += n
+		switch visibility {
+		case visibilityPublic:
+			stats.PublicMemos = n
+		case visibilityPrivate:
+			stats.PrivateMemos = n
+		case visibilityUnlisted:
+			stats.UnlistedMemos = n
+		case visibilityHidden:
+			stats.HiddenMemos = n
+		}
+	}
+	rows.Close()
+	err = dbConn.QueryRow(
+		"SELECT count(*) FROM login_failures WHERE created_at > now() - INTERVAL 1 DAY",
+	).Scan(&stats.LoginFailuresDay)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	baseUrl := prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if !requireAdmin(w, user) {
+		return
+	}
+
+	stats, err := loadSiteStats(dbConn)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	rows, err := dbConn.Query(
+		"SELECT a.id, u.username, a.action, a.target_type, a.target_id, a.detail, a.ip, a.created_at FROM admin_audit_log a JOIN users u ON (a.admin = u.id) ORDER BY a.id DESC LIMIT ?",
+		auditEntriesShown,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		e := AuditEntry{}
+		rows.Scan(&e.Id, &e.Admin, &e.Action, &e.TargetType, &e.TargetId, &e.Detail, &e.Ip, &e.CreatedAt)
+		entries = append(entries, &e)
+	}
+	rows.Close()
+
+	v := &View{
+		BaseUrl: baseUrl,
+		Locale:  requestLocale(r, user),
+		User:    user,
+		Session: session,
+		Flashes: popFlashes(w, r, session),
+		Stats:   stats,
+		Audit:   entries,
+	}
+	if err = tmpl.ExecuteTemplate(w, "admin", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+func likePattern(q string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(q) + "%"
+}
+
+func adminPage(r *http.Request) int {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
+	}
+	return page
+}
+
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	baseUrl := prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if !requireAdmin(w, user) {
+		return
+	}
+
+	q := strings.TrimSpace(r.FormValue("q"))
+	page := adminPage(r)
+	rows, err := dbConn.Query(
+		"SELECT id, username, last_access, is_admin, is_disabled, must_reset_password, (SELECT count(*) FROM memos WHERE memos.user = users.id) FROM users WHERE username LIKE ? ORDER BY id LIMIT ? OFFSET ?",
+		likePattern(q), adminUsersPerPage+1, adminUsersPerPage*page,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	users := make([]*AdminUser, 0)
+	for rows.Next() {
+		u := AdminUser{}
+		var lastAccess sql.NullString
+		rows.Scan(&u.Id, &u.Username, &lastAccess, &u.IsAdmin, &u.IsDisabled, &u.MustResetPassword, &u.Memos)
+		u.LastAccess = lastAccess.String
+		users = append(users, &u)
+	}
+	rows.Close()
+
+	v := &View{
+		BaseUrl: baseUrl,
+		Locale:  requestLocale(r, user),
+		User:    user,
+		Session: session,
+		Flashes: popFlashes(w, r, session),
+		Query:   q,
+		Page:    page,
+	}
+	if len(users) > adminUsersPerPage {
+		users = users[:adminUsersPerPage]
+		v.HasNext = true
+	}
+	v.Users = users
+	if err = tmpl.ExecuteTemplate(w, "admin_users", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+func adminMemosHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	baseUrl := prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if !requireAdmin(w, user) {
+		return
+	}
+
+	// only memos that are or were public are an admin's business
+	q := strings.TrimSpace(r.FormValue("q"))
+	page := adminPage(r)
+	rows, err := dbConn.Query(
+		"SELECT memos.id, memos.user, users.username, memos.content, memos.is_private, memos.created_at FROM memos JOIN users ON (memos.user = users.id) WHERE memos.is_private IN (?, ?) AND (memos.content LIKE ? OR users.username LIKE ?) ORDER BY memos.id DESC LIMIT ? OFFSET ?",
+		visibilityPublic, visibilityHidden, likePattern(q), likePattern(q), adminMemosPerPage+1, adminMemosPerPage*page,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos := make(Memos, 0)
+	for rows.Next() {
+		memo := Memo{}
+		rows.Scan(&memo.Id, &memo.User, &memo.Username, &memo.Content, &memo.IsPrivate, &memo.CreatedAt)
+		memos = append(memos, &memo)
+	}
+	rows.Close()
+
+	v := &View{
+		BaseUrl: baseUrl,
+		Locale:  requestLocale(r, user),
+		User:    user,
+		Session: session,
+		Flashes: popFlashes(w, r, session),
+		Query:   q,
+		Page:    page,
+	}
+	if len(memos) > adminMemosPerPage {
+		memos = memos[:adminMemosPerPage]
+		v.HasNext = true
+	}
+	v.Memos = &memos
+	if err = tmpl.ExecuteTemplate(w, "admin_memos", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+// adminUserActionHandler handles the POSTs under /admin/users/{user_id}.
+func adminUserActionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	vars := mux.Vars(r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if !requireAdmin(w, user) {
+		return
+	}
+
+	target := &User{}
+	err = dbConn.QueryRow("SELECT id, username FROM users WHERE id=?", vars["user_id"]).Scan(&target.Id, &target.Username)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	locale := requestLocale(r, user)
+	var action, message string
+	switch vars["action"] {
+	case "disable":
+		if target.Id == user.Id {
+			addFlash(session, FlashError, translate(locale, "flash.admin.cant_disable_self"))
+			break
+		}
+		disabled := r.FormValue("disabled") != "0"
+		if _, err := dbConn.Exec("UPDATE users SET is_disabled=? WHERE id=?", disabled, target.Id); err != nil {
+			serverError(w, err)
+			return
+		}
+		if disabled {
+			action, message = auditDisableUser, translate(locale, "flash.admin.user_disabled", target.Username)
+		} else {
+			action, message = auditEnableUser, translate(locale, "flash.admin.user_enabled", target.Username)
+		}
+	case "reset_password":
+		if _, err := dbConn.Exec("UPDATE users SET must_reset_password=1 WHERE id=?", target.Id); err != nil {
+			serverError(w, err)
+			return
+		}
+		action, message = auditResetPassword, translate(locale, "flash.admin.password_reset", target.Username)
+	default:
+		notFound(w)
+		return
+	}
+	if action != "" {
+		if err := audit(dbConn, r, user, action, "user", target.Id, target.Username); err != nil {
+			serverError(w, err)
+			return
+		}
+		addFlash(session, FlashInfo, message)
+	}
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/users?q="+url.QueryEscape(target.Username), http.StatusFound)
+}
+
+func adminMemoHideHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if !requireAdmin(w, user) {
+		return
+	}
+
+	memo := &Memo{}
+	err = dbConn.QueryRow("SELECT id, is_private FROM memos WHERE id=?", mux.Vars(r)["memo_id"]).Scan(&memo.Id, &memo.IsPrivate)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	hide := r.FormValue("hidden") != "0"
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	switch {
+	case hide && memo.IsPrivate == visibilityPublic:
+		if _, err := dbConn.Exec("UPDATE memos SET is_private=? WHERE id=?", visibilityHidden, memo.Id); err != nil {
+			serverError(w, err)
+			return
+		}
+		if _, err := dbConn.Exec(
+			"REPLACE INTO hidden_memos (memo, admin, reason, created_at) VALUES (?, ?, ?, now())",
+			memo.Id, user.Id, reason,
+		); err != nil {
+			serverError(w, err)
+			return
+		}
+		if err := audit(dbConn, r, user, auditHideMemo, "memo", memo.Id, reason); err != nil {
+			serverError(w, err)
+			return
+		}
+		pages.invalidate()
+		addFlash(session, FlashInfo, translate(requestLocale(r, user), "flash.admin.memo_hidden", memo.Id))
+	case !hide && memo.IsPrivate == visibilityHidden:
+		if _, err := dbConn.Exec("UPDATE memos SET is_private=? WHERE id=?", visibilityPublic, memo.Id); err != nil {
+			serverError(w, err)
+			return
+		}
+		if _, err := dbConn.Exec("DELETE FROM hidden_memos WHERE memo=?", memo.Id); err != nil {
+			serverError(w, err)
+			return
+		}
+		if err := audit(dbConn, r, user, auditUnhideMemo, "memo", memo.Id, reason); err != nil {
+			serverError(w, err)
+			return
+		}
+		pages.invalidate()
+		addFlash(session, FlashInfo, translate(requestLocale(r, user), "flash.admin.memo_unhidden", memo.Id))
+	default:
+		addFlash(session, FlashWarning, translate(requestLocale(r, user), "flash.admin.memo_unchanged", memo.Id))
+	}
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/memos", http.StatusFound)
+}
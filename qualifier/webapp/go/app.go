@@ -2,16 +2,19 @@ package main
 
 import (
 	"./sessions"
-	"crypto/sha256"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/securecookie"
 	"html/template"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,11 +22,15 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	maxConnectionCount = 256
 	memosPerPage       = 100
+	multipartMemory    = 1 << 20
+	defaultTemplateDir = "templates"
+	loginFailuresShown = 10
 	listenAddr         = ":5000"
 	sessionName        = "isucon_session"
 	tmpDir             = "/tmp/"
@@ -41,29 +48,54 @@ type Config struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"database"`
+	RateLimit      RateLimitConfig `json:"ratelimit"`
+	TrustedProxies []string        `json:"trusted_proxies"`
+	TLS            TLSConfig       `json:"tls"`
+	Datadir        string          `json:"data_dir"`
+	MaxUploadBytes int64           `json:"max_upload_bytes"`
+	MaxImportBytes int64           `json:"max_import_bytes"`
+	TemplateDir    string          `json:"template_dir"`
+	ThemeDir       string          `json:"theme_dir"`
+	DevMode        bool            `json:"dev_mode"`
+	Compress       CompressConfig  `json:"compress"`
 }
 
 type User struct {
-	Id         int
-	Username   string
-	Password   string
-	Salt       string
-	LastAccess string
+	Id                int
+	Username          string
+	Password          string
+	Salt              string
+	LastAccess        string
+	IsAdmin           bool
+	IsDisabled        bool
+	MustResetPassword bool
+	Locale            string
 }
 
 type Memo struct {
-	Id        int
-	User      int
-	Content   string
-	IsPrivate int
-	CreatedAt string
-	UpdatedAt string
-	Username  string
+	Id         int
+	User       int
+	Content    string
+	IsPrivate  int
+	CreatedAt  string
+	UpdatedAt  string
+	Username   string
+	Readers    []string
+	ShareToken string
+	Files      []*MemoFile
 }
 
 type Memos []*Memo
 
+type LoginFailure struct {
+	Ip        string
+	CreatedAt string
+}
+
 type View struct {
+	BaseUrl   *url.URL
+	Locale    string
+	FileBase  string
 	User      *User
 	Memo      *Memo
 	Memos     *Memos
@@ -74,22 +106,40 @@ type View struct {
 	Older     *Memo
 	Newer     *Memo
 	Session   *sessions.Session
+	Flashes   []*Flash
+	Failures  []*LoginFailure
+	Users     []*AdminUser
+	Stats     *SiteStats
+	Audit     []*AuditEntry
+	Query     string
+	HasNext   bool
 }
 
 var (
-	dbConnPool chan *sql.DB
-	baseUrl    *url.URL
-	fmap       = template.FuncMap{
-		"url_for": func(path string) string {
+	config         *Config
+	limiter        *loginLimiter
+	trustedProxies TrustedProxies
+	dbConnPool     chan *sql.DB
+	fmap           = template.FuncMap{
+		"url_for": func(baseUrl *url.URL, path string) string {
 			return baseUrl.String() + path
 		},
+		"t":       translate,
+		"locales": func() []string { return locales },
+		"static_url": func(baseUrl *url.URL, path string) string {
+			return baseUrl.String() + static.url(path)
+		},
 		"first_line": func(s string) string {
 			sl := strings.Split(s, "\n")
 			return sl[0]
 		},
 		"get_token": func(session *sessions.Session) interface{} {
-			return session.Values["token"]
+			return session.Values[csrfTokenKey]
 		},
+		"flash_class": flashClass,
+		"join":        strings.Join,
+		"add":         func(a, b int) int { return a + b },
+		"sub":         func(a, b int) int { return a - b },
 		"gen_markdown": func(s string) template.HTML {
 			f, _ := ioutil.TempFile(tmpDir, "isucon")
 			defer f.Close()
@@ -107,17 +157,53 @@ var (
 			return template.HTML(out)
 		},
 	}
-	tmpl = template.Must(template.New("tmpl").Funcs(fmap).ParseGlob("templates/*.html"))
+	tmpl   *templateSet
+	static *assetServer
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	fromDisk := flag.Bool("disk", false, "read templates and public files from disk instead of the embedded copies")
+	flag.Parse()
+
 	env := os.Getenv("ISUCON_ENV")
 	if env == "" {
 		env = "local"
 	}
-	config := loadConfig("../config/" + env + ".json")
+	config = loadConfig("../config/" + env + ".json")
+	limiter = newLoginLimiter(config.RateLimit)
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("invalid trusted_proxies: %v", err)
+	}
+	trustedProxies = proxies
+	// dev mode edits files on disk, so it implies -disk
+	var templates, catalogs fs.FS
+	var public http.Handler
+	if *fromDisk || config.DevMode {
+		templateDir := config.TemplateDir
+		if templateDir == "" {
+			templateDir = defaultTemplateDir
+		}
+		templates = os.DirFS(templateDir)
+		catalogs = os.DirFS("./locales/")
+		public = http.FileServer(http.Dir("./public/"))
+	} else {
+		templates = embeddedTemplates()
+		catalogs = embeddedLocales()
+		if static, err = newAssetServer(embeddedPublic()); err != nil {
+			log.Fatalf("can't load embedded public files: %v", err)
+		}
+		public = static
+	}
+	if err := loadCatalogs(catalogs); err != nil {
+		log.Fatalf("can't load locales: %v", err)
+	}
+	tmpl, err = newTemplateSet(templates, config.ThemeDir, config.DevMode)
+	if err != nil {
+		log.Fatalf("can't load templates: %v", err)
+	}
 	db := config.Database
 	connectionString := fmt.Sprintf(
 		"%s:%s@tcp(%s:%d)/%s?charset=utf8",
@@ -136,17 +222,31 @@ func main() {
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/", topHandler)
+	r.HandleFunc("/", cachePage(topHandler))
 	r.HandleFunc("/signin", signinHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/signin", signinPostHandler).Methods("POST")
-	r.HandleFunc("/signout", signoutHandler)
+	r.HandleFunc("/signout", signoutHandler).Methods("POST")
 	r.HandleFunc("/mypage", mypageHandler)
-	r.HandleFunc("/memo/{memo_id}", memoHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/mypage/export", mypageExportHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/mypage/import", mypageImportHandler).Methods("POST")
+	r.HandleFunc("/mypage/locale", localeHandler).Methods("POST")
+	r.HandleFunc("/memo/{memo_id}", cachePage(memoHandler)).Methods("GET", "HEAD")
 	r.HandleFunc("/memo", memoPostHandler).Methods("POST")
-	r.HandleFunc("/recent/{page:[0-9]+}", recentHandler)
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
-	http.Handle("/", r)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	r.HandleFunc("/memo/{memo_id}/share", memoShareHandler).Methods("POST")
+	r.HandleFunc("/memo/{memo_id}/file/{name}", memoFileHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/shared/{token:[0-9a-f]+}", sharedMemoHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/shared/{token:[0-9a-f]+}/file/{name}", sharedFileHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/recent/{page:[0-9]+}", cachePage(recentHandler))
+	r.HandleFunc("/password", passwordHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/password", passwordPostHandler).Methods("POST")
+	r.HandleFunc("/admin", adminHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/users", adminUsersHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/users/{user_id:[0-9]+}/{action}", adminUserActionHandler).Methods("POST")
+	r.HandleFunc("/admin/memos", adminMemosHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/memos/{memo_id:[0-9]+}/hide", adminMemoHideHandler).Methods("POST")
+	r.PathPrefix("/").Handler(public)
+	http.Handle("/", compressHandler(limitRequestBody(csrfProtect(r), maxUploadBytes()), config.Compress))
+	log.Fatal(listenAndServe(config.TLS, nil))
 }
 
 func loadConfig(filename string) *Config {
@@ -165,16 +265,25 @@ func loadConfig(filename string) *Config {
 	return &config
 }
 
-func prepareHandler(w http.ResponseWriter, r *http.Request) {
-	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
-		baseUrl, _ = url.Parse("http://" + h)
-	} else {
-		baseUrl, _ = url.Parse("http://" + r.Host)
-	}
+func prepareHandler(w http.ResponseWriter, r *http.Request) (baseUrl *url.URL) {
+	return requestBaseUrl(r)
+}
+
+type sessionContextKey struct{}
+
+// withSession hands session on to the handlers of r, so that it is read
+// from memcached once per request.
+func withSession(r *http.Request, session *sessions.Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session))
 }
 
 func loadSession(w http.ResponseWriter, r *http.Request) (session *sessions.Session, err error) {
+	if session, ok := r.Context().Value(sessionContextKey{}).(*sessions.Session); ok {
+		return session, nil
+	}
 	store := sessions.NewMemcacheStore(memcachedServer, []byte(sessionSecret))
+	store.Options.HttpOnly = true
+	store.Options.Secure = requestBaseUrl(r).Scheme == "https"
 	return store.Get(r, sessionName)
 }
 
@@ -184,28 +293,25 @@ func getUser(w http.ResponseWriter, r *http.Request, dbConn *sql.DB, session *se
 		return nil
 	}
 	user := &User{}
-	rows, err := dbConn.Query("SELECT * FROM users WHERE id=?", userId)
+	var lastAccess sql.NullString
+	rows, err := dbConn.Query("SELECT id, username, password, salt, last_access, is_admin, is_disabled, must_reset_password, locale FROM users WHERE id=?", userId)
 	if err != nil {
 		serverError(w, err)
 		return nil
 	}
 	if rows.Next() {
-		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &user.LastAccess)
+		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &lastAccess, &user.IsAdmin, &user.IsDisabled, &user.MustResetPassword, &user.Locale)
+		user.LastAccess = lastAccess.String
 		rows.Close()
 	}
 	if user != nil {
 		w.Header().Add("Cache-Control", "private")
 	}
-	return user
-}
-
-func antiCSRF(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
-	if r.FormValue("sid") != session.Values["token"] {
-		code := http.StatusBadRequest
-		http.Error(w, http.StatusText(code), code)
-		return true
+	// disabling an account or forcing a password reset ends its sessions
+	if user.IsDisabled || user.MustResetPassword {
+		return nil
 	}
-	return false
+	return user
 }
 
 func serverError(w http.ResponseWriter, err error) {
@@ -219,13 +325,23 @@ func notFound(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(code), code)
 }
 
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	code := http.StatusTooManyRequests
+	http.Error(w, http.StatusText(code), code)
+}
+
 func topHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
+	baseUrl := prepareHandler(w, r)
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
@@ -264,6 +380,8 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 	rows.Close()
 
 	v := &View{
+		BaseUrl:   baseUrl,
+		Locale:    requestLocale(r, user),
 		Total:     totalCount,
 		Page:      0,
 		PageStart: 1,
@@ -271,6 +389,7 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 		Memos:     &memos,
 		User:      user,
 		Session:   session,
+		Flashes:   popFlashes(w, r, session),
 	}
 	if err = tmpl.ExecuteTemplate(w, "index", v); err != nil {
 		serverError(w, err)
@@ -283,7 +402,7 @@ func recentHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
+	baseUrl := prepareHandler(w, r)
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
@@ -327,6 +446,8 @@ func recentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	v := &View{
+		BaseUrl:   baseUrl,
+		Locale:    requestLocale(r, user),
 		Total:     totalCount,
 		Page:      page,
 		PageStart: memosPerPage*page + 1,
@@ -334,6 +455,7 @@ func recentHandler(w http.ResponseWriter, r *http.Request) {
 		Memos:     &memos,
 		User:      user,
 		Session:   session,
+		Flashes:   popFlashes(w, r, session),
 	}
 	if err = tmpl.ExecuteTemplate(w, "index", v); err != nil {
 		serverError(w, err)
@@ -346,7 +468,7 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
+	baseUrl := prepareHandler(w, r)
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
@@ -354,8 +476,11 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUser(w, r, dbConn, session)
 
 	v := &View{
+		BaseUrl: baseUrl,
+		Locale:  requestLocale(r, user),
 		User:    user,
 		Session: session,
+		Flashes: popFlashes(w, r, session),
 	}
 	if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
 		serverError(w, err)
@@ -369,7 +494,7 @@ func signinPostHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
+	baseUrl := prepareHandler(w, r)
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
@@ -377,22 +502,72 @@ func signinPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	ip := clientIP(r)
+	if wait, err := limiter.allow(username, ip); err != nil {
+		serverError(w, err)
+		return
+	} else if wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
 	user := &User{}
-	rows, err := dbConn.Query("SELECT id, username, password, salt FROM users WHERE username=?", username)
+	var lastAccess sql.NullString
+	rows, err := dbConn.Query("SELECT id, username, password, salt, last_access, is_disabled, must_reset_password, locale FROM users WHERE username=?", username)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 	if rows.Next() {
-		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt)
+		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &lastAccess, &user.IsDisabled, &user.MustResetPassword, &user.Locale)
 	}
 	rows.Close()
 	if user.Id > 0 {
-		h := sha256.New()
-		h.Write([]byte(user.Salt + password))
-		if user.Password == fmt.Sprintf("%x", h.Sum(nil)) {
+		if user.Password == hashPassword(user.Salt, password) {
+			if err := limiter.succeeded(username); err != nil {
+				log.Printf("can't reset login limiter: %v", err)
+			}
+			if user.IsDisabled {
+				locale := requestLocale(r, nil)
+				v := &View{
+					BaseUrl: baseUrl,
+					Locale:  locale,
+					Session: session,
+					Flashes: []*Flash{{Level: FlashError, Message: translate(locale, "flash.account_disabled")}},
+				}
+				if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
+					serverError(w, err)
+				}
+				return
+			}
+			if user.MustResetPassword {
+				delete(session.Values, "user_id")
+				session.Values[resetUserKey] = user.Id
+				session.Values[csrfTokenKey] = newCSRFToken()
+				addFlash(session, FlashWarning, translate(requestLocale(r, user), "flash.password_reset"))
+				if err := session.Save(r, w); err != nil {
+					serverError(w, err)
+					return
+				}
+				http.Redirect(w, r, "/password", http.StatusFound)
+				return
+			}
+			if lastAccess.Valid {
+				var failures int
+				err := dbConn.QueryRow(
+					"SELECT count(*) FROM login_failures WHERE user=? AND created_at > ?",
+					user.Id, lastAccess.String,
+				).Scan(&failures)
+				if err != nil {
+					serverError(w, err)
+					return
+				}
+				if failures > 0 {
+					addFlash(session, FlashWarning, translate(requestLocale(r, user), "flash.signin_failures", failures))
+				}
+			}
 			session.Values["user_id"] = user.Id
-			session.Values["token"] = fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+			session.Values[csrfTokenKey] = newCSRFToken()
 			if err := session.Save(r, w); err != nil {
 				serverError(w, err)
 				return
@@ -405,9 +580,23 @@ func signinPostHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		if _, err := dbConn.Exec(
+			"INSERT INTO login_failures (user, ip, created_at) VALUES (?, ?, now())",
+			user.Id, ip,
+		); err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+	if err := limiter.failed(username); err != nil {
+		log.Printf("can't record login failure: %v", err)
 	}
+	locale := requestLocale(r, nil)
 	v := &View{
+		BaseUrl: baseUrl,
+		Locale:  locale,
 		Session: session,
+		Flashes: []*Flash{{Level: FlashError, Message: translate(locale, "flash.signin_failed")}},
 	}
 	if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
 		serverError(w, err)
@@ -422,11 +611,18 @@ func signoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	prepareHandler(w, r)
-	if antiCSRF(w, r, session) {
+
+	// drop the credentials server-side too, so a copied cookie and token
+	// stop working after signout
+	delete(session.Values, "user_id")
+	delete(session.Values, csrfTokenKey)
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
 		return
 	}
-
-	http.SetCookie(w, sessions.NewCookie(sessionName, "", &sessions.Options{MaxAge: -1}))
+	expire := *session.Options
+	expire.MaxAge = -1
+	http.SetCookie(w, sessions.NewCookie(sessionName, "", &expire))
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -436,7 +632,7 @@ func mypageHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
+	baseUrl := prepareHandler(w, r)
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
@@ -458,10 +654,33 @@ func mypageHandler(w http.ResponseWriter, r *http.Request) {
 		rows.Scan(&memo.Id, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
 		memos = append(memos, &memo)
 	}
+	rows.Close()
+	if err := loadSharing(dbConn, user.Id, memos); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	rows, err = dbConn.Query("SELECT ip, created_at FROM login_failures WHERE user=? ORDER BY created_at DESC LIMIT ?", user.Id, loginFailuresShown)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	failures := make([]*LoginFailure, 0)
+	for rows.Next() {
+		f := LoginFailure{}
+		rows.Scan(&f.Ip, &f.CreatedAt)
+		failures = append(failures, &f)
+	}
+	rows.Close()
+
 	v := &View{
-		Memos:   &memos,
-		User:    user,
-		Session: session,
+		BaseUrl:  baseUrl,
+		Locale:   requestLocale(r, user),
+		Memos:    &memos,
+		User:     user,
+		Session:  session,
+		Flashes:  popFlashes(w, r, session),
+		Failures: failures,
 	}
 	if err = tmpl.ExecuteTemplate(w, "mypage", v); err != nil {
 		serverError(w, err)
@@ -474,7 +693,7 @@ func memoHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	prepareHandler(w, r)
+	baseUrl := prepareHandler(w, r)
 	vars := mux.Vars(r)
 	memoId := vars["memo_id"]
 	dbConn := <-dbConnPool
@@ -496,13 +715,18 @@ func memoHandler(w http.ResponseWriter, r *http.Request) {
 		notFound(w)
 		return
 	}
-	if memo.IsPrivate == 1 {
-		if user == nil || user.Id != memo.User {
-			notFound(w)
-			return
-		}
+	if ok, err := canReadMemo(dbConn, memo, user); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
+		notFound(w)
+		return
 	}
-	rows, err = dbConn.Query("SELECT username FROM users WHERE id=?", memo.User)
+	renderMemo(w, r, dbConn, session, baseUrl, user, memo, fmt.Sprintf("%s/memo/%d/file/", baseUrl, memo.Id))
+}
+
+func renderMemo(w http.ResponseWriter, r *http.Request, dbConn *sql.DB, session *sessions.Session, baseUrl *url.URL, user *User, memo *Memo, fileBase string) {
+	rows, err := dbConn.Query("SELECT username FROM users WHERE id=?", memo.User)
 	if err != nil {
 		serverError(w, err)
 		return
@@ -512,13 +736,28 @@ func memoHandler(w http.ResponseWriter, r *http.Request) {
 		rows.Close()
 	}
 
-	var cond string
+	if err := loadAttachments(dbConn, memo); err != nil {
+		serverError(w, err)
+		return
+	}
+	memo.Content = expandAttachmentLinks(memo.Content, fileBase)
+
+	// neighbours are the author's memos this user could open by id
 	if user != nil && user.Id == memo.User {
-		cond = ""
+		if err := loadReaders(dbConn, memo); err != nil {
+			serverError(w, err)
+			return
+		}
+		if err := loadShareToken(dbConn, memo); err != nil {
+			serverError(w, err)
+			return
+		}
+		rows, err = dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? ORDER BY created_at", memo.User)
+	} else if user != nil {
+		rows, err = dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? AND (is_private=0 OR id IN (SELECT memo FROM memo_readers WHERE user=?)) ORDER BY created_at", memo.User, user.Id)
 	} else {
-		cond = "AND is_private=0"
+		rows, err = dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? AND is_private=0 ORDER BY created_at", memo.User)
 	}
-	rows, err = dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? "+cond+" ORDER BY created_at", memo.User)
 	if err != nil {
 		serverError(w, err)
 		return
@@ -544,11 +783,15 @@ func memoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	v := &View{
-		User:    user,
-		Memo:    memo,
-		Older:   older,
-		Newer:   newer,
-		Session: session,
+		BaseUrl:  baseUrl,
+		Locale:   requestLocale(r, user),
+		FileBase: fileBase,
+		User:     user,
+		Memo:     memo,
+		Older:    older,
+		Newer:    newer,
+		Session:  session,
+		Flashes:  popFlashes(w, r, session),
 	}
 	if err = tmpl.ExecuteTemplate(w, "memo", v); err != nil {
 		serverError(w, err)
@@ -562,9 +805,6 @@ func memoPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	prepareHandler(w, r)
-	if antiCSRF(w, r, session) {
-		return
-	}
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
@@ -575,20 +815,64 @@ func memoPostHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	var isPrivate int
-	if r.FormValue("is_private") == "1" {
-		isPrivate = 1
-	} else {
-		isPrivate = 0
+	var attachments []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		attachments = r.MultipartForm.File["attachments"]
+	}
+	if err := checkAttachments(attachments); err == errTooManyAttachments {
+		addFlash(session, FlashError, translate(requestLocale(r, user), "flash.too_many_attachments", maxAttachments))
+		if err := session.Save(r, w); err != nil {
+			serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/mypage", http.StatusFound)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	isPrivate := parseVisibility(r.FormValue("is_private"))
+	tx, err := dbConn.Begin()
+	if err != nil {
+		serverError(w, err)
+		return
 	}
-	result, err := dbConn.Exec(
+	result, err := tx.Exec(
 		"INSERT INTO memos (user, content, is_private, created_at) VALUES (?, ?, ?, now())",
 		user.Id, r.FormValue("content"), isPrivate,
 	)
 	if err != nil {
+		tx.Rollback()
 		serverError(w, err)
 		return
 	}
 	newId, _ := result.LastInsertId()
+	if err := saveAttachments(tx, newId, attachments); err != nil {
+		tx.Rollback()
+		serverError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		removeAttachments(newId)
+		serverError(w, err)
+		return
+	}
+	readers := parseReaders(r.FormValue("readers"))
+	if isPrivate == visibilityUnlisted || len(readers) > 0 {
+		unknown, err := setSharing(dbConn, newId, user.Id, isPrivate, readers)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if len(unknown) > 0 {
+			addFlash(session, FlashWarning, translate(requestLocale(r, user), "flash.no_such_user", strings.Join(unknown, ", ")))
+		}
+	}
+	pages.invalidate()
+	addFlash(session, FlashInfo, translate(requestLocale(r, user), "flash.memo_posted"))
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
 	http.Redirect(w, r, fmt.Sprintf("/memo/%d", newId), http.StatusFound)
 }
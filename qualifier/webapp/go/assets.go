@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// hashed asset URLs never change content, so they may be cached for good
+const assetMaxAge = 365 * 24 * time.Hour
+
+// asset is one public file with the compressed variants gen_assets.sh put
+// next to it.
+type asset struct {
+	name        string
+	hashed      string
+	contentType string
+	data        []byte
+	gzip        []byte
+	brotli      []byte
+	etag        string
+}
+
+// assetServer serves the public files from memory. ETags are computed once
+// at startup, and a compressed variant is sent when the client accepts it.
+// Every file is also served under a name with its content hash in it, see
+// url.
+type assetServer struct {
+	files   map[string]*asset
+	hashed  map[string]*asset
+	modTime time.Time
+}
+
+func newAssetServer(fsys fs.FS) (*assetServer, error) {
+	s := &assetServer{
+		files:   make(map[string]*asset),
+		hashed:  make(map[string]*asset),
+		modTime: time.Now(),
+	}
+	variants := make(map[string][]byte)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".br") {
+			variants[name] = data
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		a := &asset{
+			name:        name,
+			hashed:      hashedName("/"+name, sum[:]),
+			contentType: assetContentType(name, data),
+			data:        data,
+			etag:        fmt.Sprintf(`"%x"`, sum),
+		}
+		s.files["/"+name] = a
+		s.hashed[a.hashed] = a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range s.files {
+		a.gzip = variants[a.name+".gz"]
+		a.brotli = variants[a.name+".br"]
+	}
+	return s, nil
+}
+
+// hashedName puts the start of the content hash before the extension,
+// e.g. /css/bootstrap.min.css becomes /css/bootstrap.min.0123456789ab.css.
+func hashedName(name string, sum []byte) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s.%x%s", strings.TrimSuffix(name, ext), sum[:6], ext)
+}
+
+// url is the content hashed path of the public file at name, or name itself
+// when there is no such file or s is nil because files come from disk.
+func (s *assetServer) url(name string) string {
+	if s == nil {
+		return name
+	}
+	if a, ok := s.files[name]; ok {
+		return a.hashed
+	}
+	return name
+}
+
+func assetContentType(name string, data []byte) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(data)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != coding {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q := strings.Replace(param, " ", "", -1); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// addVary adds field to the Vary header unless it is listed already, as
+// both the asset server and compressHandler vary on Accept-Encoding.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+func (s *assetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	h := w.Header()
+	a, ok := s.hashed[name]
+	if ok {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", assetMaxAge/time.Second))
+		h.Set("Expires", time.Now().Add(assetMaxAge).UTC().Format(http.TimeFormat))
+	} else {
+		if a, ok = s.files[name]; !ok {
+			a, ok = s.files[strings.TrimSuffix(name, "/")+"/index.html"]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// plain names may change content with the next deploy
+		h.Set("Cache-Control", "public, no-cache")
+	}
+
+	data, etag := a.data, a.etag
+	if a.gzip != nil || a.brotli != nil {
+		addVary(h, "Accept-Encoding")
+	}
+	switch {
+	case a.brotli != nil && acceptsEncoding(r, "br"):
+		data = a.brotli
+		etag = strings.TrimSuffix(etag, `"`) + `-br"`
+		h.Set("Content-Encoding", "br")
+	case a.gzip != nil && acceptsEncoding(r, "gzip"):
+		data = a.gzip
+		etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+		h.Set("Content-Encoding", "gzip")
+	}
+	h.Set("Content-Type", a.contentType)
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, a.name, s.modTime, bytes.NewReader(data))
+}
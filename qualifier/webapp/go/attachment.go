@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultMaxUploadBytes = 10 << 20
+	maxAttachments        = 10
+	attachmentScheme      = "attachment:"
+)
+
+type MemoFile struct {
+	Id          int
+	Memo        int
+	Name        string
+	ContentType string
+	Size        int64
+	CreatedAt   string
+}
+
+// content types served inline; anything else is sent as a download so an
+// uploaded page can't run script on our origin
+var inlineContentTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func sanitizeFileName(name string) string {
+	name = filepath.Base(strings.Replace(name, `\`, "/", -1))
+	name = unsafeFileChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, ".")
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return !os.IsNotExist(err)
+}
+
+func attachmentDir(memoId int64) string {
+	return fmt.Sprintf("%s/attachments/%d", config.Datadir, memoId)
+}
+
+func requestTooLarge(w http.ResponseWriter) {
+	code := http.StatusRequestEntityTooLarge
+	http.Error(w, http.StatusText(code), code)
+}
+
+// routes that take larger bodies than the rest, see limitRequestBody
+var bodyLimits = map[string]func() int64{
+	"/mypage/import": maxImportBytes,
+}
+
+func limitRequestBody(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			limit := n
+			if f, ok := bodyLimits[r.URL.Path]; ok {
+				limit = f()
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func maxUploadBytes() int64 {
+	if config.MaxUploadBytes > 0 {
+		return config.MaxUploadBytes
+	}
+	return defaultMaxUploadBytes
+}
+
+var errTooManyAttachments = fmt.Errorf("at most %d files can be attached", maxAttachments)
+
+// checkAttachments opens every uploaded file before the memo is written,
+// so it is not left with only some of them.
+func checkAttachments(headers []*multipart.FileHeader) error {
+	if len(headers) > maxAttachments {
+		return errTooManyAttachments
+	}
+	for _, fh := range headers {
+		f, err := fh.Open()
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// saveAttachments stores the uploaded files of a memo written in tx. The
+// files are removed again if it fails; if tx is not committed after all the
+// caller removes them with removeAttachments.
+func saveAttachments(tx *sql.Tx, memoId int64, headers []*multipart.FileHeader) error {
+	for _, fh := range headers {
+		src, err := fh.Open()
+		if err == nil {
+			err = addAttachment(tx, memoId, fh.Filename, src)
+			src.Close()
+		}
+		if err != nil {
+			removeAttachments(memoId)
+			return err
+		}
+	}
+	return nil
+}
+
+// addAttachment stores one file of a memo. Names are made unique within the
+// memo by numbering duplicates.
+func addAttachment(tx *sql.Tx, memoId int64, name string, src io.Reader) error {
+	dir := attachmentDir(memoId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name = sanitizeFileName(name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; fileExists(dir + "/" + name); i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	size, contentType, err := saveAttachment(src, dir+"/"+name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO memo_files (memo, name, content_type, size, created_at) VALUES (?, ?, ?, ?, now())",
+		memoId, name, contentType, size,
+	)
+	return err
+}
+
+func removeAttachments(memoId int64) {
+	if err := os.RemoveAll(attachmentDir(memoId)); err != nil {
+		log.Printf("can't remove attachments of memo %d: %s", memoId, err)
+	}
+}
+
+func saveAttachment(src io.Reader, path string) (int64, string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, "", err
+	}
+	contentType := http.DetectContentType(head[:n])
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer dst.Close()
+	size, err := io.Copy(dst, io.MultiReader(bytes.NewReader(head[:n]), src))
+	if err != nil {
+		os.Remove(path)
+		return 0, "", err
+	}
+	return size, contentType, nil
+}
+
+func loadAttachments(dbConn *sql.DB, memo *Memo) error {
+	rows, err := dbConn.Query("SELECT id, memo, name, content_type, size, created_at FROM memo_files WHERE memo=? ORDER BY id", memo.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	memo.Files = make([]*MemoFile, 0)
+	for rows.Next() {
+		f := MemoFile{}
+		rows.Scan(&f.Id, &f.Memo, &f.Name, &f.ContentType, &f.Size, &f.CreatedAt)
+		memo.Files = append(memo.Files, &f)
+	}
+	return nil
+}
+
+// expandAttachmentLinks turns "attachment:name" references in markdown into
+// URLs under fileBase, so authors can link files before the memo has an id.
+func expandAttachmentLinks(content string, fileBase string) string {
+	return strings.Replace(content, "]("+attachmentScheme, "]("+fileBase, -1)
+}
+
+func serveAttachment(w http.ResponseWriter, r *http.Request, dbConn *sql.DB, memo *Memo, name string) {
+	f := MemoFile{}
+	err := dbConn.QueryRow(
+		"SELECT id, name, content_type, size FROM memo_files WHERE memo=? AND name=?", memo.Id, name,
+	).Scan(&f.Id, &f.Name, &f.ContentType, &f.Size)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	file, err := os.Open(attachmentDir(int64(memo.Id)) + "/" + f.Name)
+	if os.IsNotExist(err) {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if inlineContentTypes[f.ContentType] {
+		w.Header().Set("Content-Type", f.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.QueryEscape(f.Name))
+	}
+	if memo.IsPrivate != visibilityPublic {
+		w.Header().Set("Cache-Control", "private")
+	}
+	http.ServeContent(w, r, f.Name, stat.ModTime(), file)
+}
+
+func memoFileHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	vars := mux.Vars(r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+
+	memo := &Memo{}
+	err = dbConn.QueryRow("SELECT id, user, is_private FROM memos WHERE id=?", vars["memo_id"]).Scan(&memo.Id, &memo.User, &memo.IsPrivate)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if ok, err := canReadMemo(dbConn, memo, user); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
+		notFound(w)
+		return
+	}
+	serveAttachment(w, r, dbConn, memo, vars["name"])
+}
+
+func sharedFileHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+	vars := mux.Vars(r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+
+	memo := &Memo{}
+	err := dbConn.QueryRow(
+		"SELECT memos.id, memos.user, memos.is_private FROM memo_shares JOIN memos ON (memo_shares.memo = memos.id) WHERE memo_shares.token=? AND memos.is_private=?",
+		vars["token"], visibilityUnlisted,
+	).Scan(&memo.Id, &memo.User, &memo.IsPrivate)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	serveAttachment(w, r, dbConn, memo, vars["name"])
+}
@@ -0,0 +1,11 @@
+#!/bin/bash -x
+
+cd $(dirname $0)
+
+GOPATH=/home/isucon/local/go
+go get github.com/go-sql-driver/mysql
+go get github.com/gorilla/mux
+go get github.com/gorilla/sessions
+go get github.com/bradfitz/gomemcache/memcache
+go generate
+go build -o app
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const defaultCompressMinSize = 1024
+
+type CompressConfig struct {
+	Disabled bool `json:"disabled"`
+	MinSize  int  `json:"min_size"`
+	Level    int  `json:"level"`
+}
+
+// content types that are compressed already or must reach the client as
+// they are written
+var incompressibleTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"application/zip",
+	"application/gzip",
+	"application/octet-stream",
+	"text/event-stream",
+}
+
+func compressible(contentType string) bool {
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+type compressor struct {
+	encoding string
+	minSize  int
+	level    int
+	pool     sync.Pool
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func (c *compressor) get(w io.Writer) resetWriter {
+	if cw, ok := c.pool.Get().(resetWriter); ok {
+		cw.Reset(w)
+		return cw
+	}
+	if c.encoding == "gzip" {
+		cw, _ := gzip.NewWriterLevel(w, c.level)
+		return cw
+	}
+	cw, _ := zlib.NewWriterLevel(w, c.level)
+	return cw
+}
+
+// compressHandler compresses responses with gzip, or deflate for clients
+// that only take that. Responses smaller than the minimum size, already
+// encoded or of an incompressible type such as the JPEG and PNG images go
+// out as they are.
+func compressHandler(h http.Handler, c CompressConfig) http.Handler {
+	if c.Disabled {
+		return h
+	}
+	if c.MinSize <= 0 {
+		c.MinSize = defaultCompressMinSize
+	}
+	if c.Level == 0 || c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression {
+		c.Level = gzip.DefaultCompression
+	}
+	gz := &compressor{encoding: "gzip", minSize: c.MinSize, level: c.Level}
+	deflate := &compressor{encoding: "deflate", minSize: c.MinSize, level: c.Level}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cmp *compressor
+		switch {
+		case r.Header.Get("Range") != "":
+			// ranges are of the identity encoding
+		case acceptsEncoding(r, "gzip"):
+			cmp = gz
+		case acceptsEncoding(r, "deflate"):
+			cmp = deflate
+		}
+		addVary(w.Header(), "Accept-Encoding")
+		if cmp == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, compressor: cmp}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// it is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *compressor
+	status     int
+	buf        bytes.Buffer
+	decided    bool
+	cw         resetWriter
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf.Write(b)
+		if w.buf.Len() >= w.compressor.minSize {
+			if err := w.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the header, compressing if big says the response is large
+// enough, and then whatever was buffered.
+func (w *compressWriter) decide(big bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if h.Get("Content-Type") == "" && w.buf.Len() > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf.Bytes()))
+	}
+	if big && w.status != http.StatusNoContent && w.status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.compressor.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.cw = w.compressor.get(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.cw != nil {
+		_, err = w.cw.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			// nothing was written, let net/http send its default response
+			return
+		}
+		w.decide(false)
+	}
+	if w.cw != nil {
+		w.cw.Close()
+		w.cw.Reset(io.Discard)
+		w.compressor.pool.Put(w.cw)
+		w.cw = nil
+	}
+}
+
+// Flush sends what has been written so far, which streaming handlers rely
+// on even before the minimum size is reached.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(w.buf.Len() >= w.compressor.minSize)
+	}
+	if f, ok := w.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to set
+// write deadlines.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.decided = true
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("compress: connection can't be hijacked")
+}
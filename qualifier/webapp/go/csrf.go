@@ -0,0 +1,126 @@
+package main
+
+import (
+	"./sessions"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "sid"
+	csrfTokenKey  = "token"
+)
+
+var (
+	errCSRFOrigin = errors.New("csrf: cross-origin request")
+	errCSRFToken  = errors.New("csrf: invalid token")
+)
+
+// routes that change state but are reached before a session has a token
+var csrfExempt = map[string]bool{
+	"/signin": true,
+}
+
+func newCSRFToken() string {
+	return fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// checkOrigin rejects requests whose Origin, or Referer when Origin is
+// absent, points at another host. Requests carrying neither are let through
+// and left to the token check.
+func checkOrigin(r *http.Request) error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Referer()
+	}
+	if source == "" {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" || u.Host != requestBaseUrl(r).Host {
+		return errCSRFOrigin
+	}
+	return nil
+}
+
+func checkCSRFToken(r *http.Request, session *sessions.Session) error {
+	expected, ok := session.Values[csrfTokenKey].(string)
+	if !ok || expected == "" {
+		return errCSRFToken
+	}
+	actual := r.Header.Get(csrfHeader)
+	if actual == "" {
+		actual = r.FormValue(csrfFormField)
+	}
+	if subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) != 1 {
+		return errCSRFToken
+	}
+	return nil
+}
+
+func checkCSRF(r *http.Request, session *sessions.Session) error {
+	if isSafeMethod(r.Method) {
+		return nil
+	}
+	if err := checkOrigin(r); err != nil {
+		return err
+	}
+	if csrfExempt[r.URL.Path] {
+		return nil
+	}
+	return checkCSRFToken(r, session)
+}
+
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if err := r.ParseMultipartForm(multipartMemory); err != nil && err != http.ErrNotMultipart {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				requestTooLarge(w)
+				return
+			}
+		}
+		session, err := loadSession(w, r)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if err := checkCSRF(r, session); err != nil {
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			csrfFailure(w, r, session)
+			return
+		}
+		h.ServeHTTP(w, withSession(r, session))
+	})
+}
+
+func csrfFailure(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	addFlash(session, FlashError, translate(requestLocale(r, nil), "flash.session_expired"))
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	if session.Values["user_id"] != nil {
+		http.Redirect(w, r, "/mypage", http.StatusFound)
+	} else {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
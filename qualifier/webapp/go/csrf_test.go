@@ -0,0 +1,238 @@
+package main
+
+import (
+	"./sessions"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testToken = "0123456789abcdef"
+
+func newTestSession(token interface{}) *sessions.Session {
+	session := sessions.NewSession(nil, sessionName)
+	if token != nil {
+		session.Values[csrfTokenKey] = token
+	}
+	return session
+}
+
+func newPostRequest(path string, form url.Values) *http.Request {
+	r, _ := http.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestCSRFSafeMethods(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD", "OPTIONS"} {
+		r, _ := http.NewRequest(method, "http://example.com/mypage", nil)
+		if err := checkCSRF(r, newTestSession(nil)); err != nil {
+			t.Errorf("%s: expected no error, got %v", method, err)
+		}
+	}
+}
+
+func TestCSRFValidToken(t *testing.T) {
+	r := newPostRequest("/memo", url.Values{"sid": {testToken}})
+	if err := checkCSRF(r, newTestSession(testToken)); err != nil {
+		t.Errorf("form token: expected no error, got %v", err)
+	}
+
+	r = newPostRequest("/memo", url.Values{})
+	r.Header.Set(csrfHeader, testToken)
+	if err := checkCSRF(r, newTestSession(testToken)); err != nil {
+		t.Errorf("header token: expected no error, got %v", err)
+	}
+}
+
+func TestCSRFBypass(t *testing.T) {
+	tests := []struct {
+		name    string
+		session interface{}
+		form    url.Values
+		header  string
+	}{
+		{"no session token and no form token", nil, url.Values{}, ""},
+		{"no session token and empty form token", nil, url.Values{"sid": {""}}, ""},
+		{"empty session token and empty form token", "", url.Values{"sid": {""}}, ""},
+		{"non-string session token", 42, url.Values{"sid": {"42"}}, ""},
+		{"wrong token", testToken, url.Values{"sid": {"fedcba9876543210"}}, ""},
+		{"token prefix", testToken, url.Values{"sid": {testToken[:8]}}, ""},
+		{"token with suffix", testToken, url.Values{"sid": {testToken + "00"}}, ""},
+		{"wrong header token", testToken, url.Values{}, "fedcba9876543210"},
+		{"wrong header overrides form", testToken, url.Values{"sid": {testToken}}, "fedcba9876543210"},
+	}
+	for _, tt := range tests {
+		r := newPostRequest("/memo", tt.form)
+		if tt.header != "" {
+			r.Header.Set(csrfHeader, tt.header)
+		}
+		if err := checkCSRF(r, newTestSession(tt.session)); err != errCSRFToken {
+			t.Errorf("%s: expected %v, got %v", tt.name, errCSRFToken, err)
+		}
+	}
+}
+
+func TestCSRFOrigin(t *testing.T) {
+	form := url.Values{"sid": {testToken}}
+	tests := []struct {
+		header string
+		value  string
+		err    error
+	}{
+		{"Origin", "http://example.com", nil},
+		{"Origin", "http://evil.example.org", errCSRFOrigin},
+		{"Origin", "http://example.com.evil.example.org", errCSRFOrigin},
+		{"Origin", "null", errCSRFOrigin},
+		{"Referer", "http://example.com/mypage", nil},
+		{"Referer", "http://evil.example.org/example.com", errCSRFOrigin},
+		{"Referer", "/mypage", errCSRFOrigin},
+	}
+	for _, tt := range tests {
+		r := newPostRequest("/memo", form)
+		r.Header.Set(tt.header, tt.value)
+		if err := checkCSRF(r, newTestSession(testToken)); err != tt.err {
+			t.Errorf("%s: %s: expected %v, got %v", tt.header, tt.value, tt.err, err)
+		}
+	}
+}
+
+func TestCSRFExemptSignin(t *testing.T) {
+	r := newPostRequest("/signin", url.Values{"username": {"isucon1"}})
+	if err := checkCSRF(r, newTestSession(nil)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	r = newPostRequest("/signin", url.Values{"username": {"isucon1"}})
+	r.Header.Set("Origin", "http://evil.example.org")
+	if err := checkCSRF(r, newTestSession(nil)); err != errCSRFOrigin {
+		t.Errorf("expected %v, got %v", errCSRFOrigin, err)
+	}
+}
+
+// signinDB is the one user signinPostHandler looks up, behind a
+// database/sql driver that only knows its statements.
+type signinDB struct {
+	password          string
+	mustResetPassword bool
+}
+
+var testSigninDB *signinDB
+
+type signinConn struct{}
+type signinStmt struct{ query string }
+
+type signinRows struct {
+	values [][]driver.Value
+}
+
+func (signinConn) Prepare(query string) (driver.Stmt, error) { return signinStmt{query}, nil }
+func (signinConn) Close() error                              { return nil }
+func (signinConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s signinStmt) Close() error  { return nil }
+func (s signinStmt) NumInput() int { return -1 }
+
+func (s signinStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(s.query, "UPDATE users SET last_access=now() ") {
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unexpected statement %q", s.query)
+}
+
+func (s signinStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasSuffix(s.query, " FROM users WHERE username=?") {
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	rows := &signinRows{}
+	if args[0] == "isucon1" {
+		db := testSigninDB
+		// a NULL last_access has no failures to count
+		rows.values = append(rows.values, []driver.Value{int64(1), "isucon1", hashPassword("salt", db.password), "salt", nil, false, db.mustResetPassword, "en"})
+	}
+	return rows, nil
+}
+
+func (r *signinRows) Columns() []string {
+	return []string{"id", "username", "password", "salt", "last_access", "is_disabled", "must_reset_password", "locale"}
+}
+
+func (r *signinRows) Close() error { return nil }
+
+func (r *signinRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+type signinDriver struct{}
+
+func (signinDriver) Open(name string) (driver.Conn, error) { return signinConn{}, nil }
+
+func init() {
+	sql.Register("signintest", signinDriver{})
+}
+
+// useSigninDB serves signinPostHandler from db until the test is over.
+func useSigninDB(t *testing.T, db *signinDB) {
+	oldPool, oldLimiter := dbConnPool, limiter
+	t.Cleanup(func() { dbConnPool, limiter = oldPool, oldLimiter })
+	dbConn, err := sql.Open("signintest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSigninDB = db
+	dbConnPool = make(chan *sql.DB, 1)
+	dbConnPool <- dbConn
+	limiter = newLoginLimiter(RateLimitConfig{})
+}
+
+// signin posts the form to signinPostHandler with session.
+func signin(session *sessions.Session, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	signinPostHandler(w, withSession(newPostRequest("/signin", form), session))
+	return w
+}
+
+func TestCSRFTokenRotatesOnSignin(t *testing.T) {
+	tests := []struct {
+		mustResetPassword bool
+		location          string
+	}{
+		{false, "/mypage"},
+		// the session is half signed in until the password is changed
+		{true, "/password"},
+	}
+	for _, tt := range tests {
+		useSigninDB(t, &signinDB{password: "isucon1", mustResetPassword: tt.mustResetPassword})
+		session, _ := sessions.NewCookieStore([]byte(sessionSecret)).New(newPostRequest("/signin", nil), sessionName)
+		session.Values[csrfTokenKey] = testToken
+		location := signin(session, url.Values{"username": {"isucon1"}, "password": {"isucon1"}}).Header().Get("Location")
+		if location != tt.location {
+			t.Errorf("%+v: redirected to %q", tt, location)
+		}
+
+		token, _ := session.Values[csrfTokenKey].(string)
+		if token == testToken || len(token) != 64 {
+			t.Errorf("%+v: token after signin is %q", tt, token)
+		}
+		r := newPostRequest("/memo", url.Values{"sid": {testToken}})
+		if err := checkCSRF(r, session); err != errCSRFToken {
+			t.Errorf("%+v: token from before signin: expected %v, got %v", tt, errCSRFToken, err)
+		}
+		r = newPostRequest("/memo", url.Values{"sid": {token}})
+		if err := checkCSRF(r, session); err != nil {
+			t.Errorf("%+v: new token: expected no error, got %v", tt, err)
+		}
+	}
+}
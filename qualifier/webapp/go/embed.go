@@ -0,0 +1,35 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:generate ./gen_assets.sh
+
+//go:embed templates/*.html locales/*.json embedded/public
+var embedded embed.FS
+
+func embeddedTemplates() fs.FS {
+	templates, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+func embeddedPublic() fs.FS {
+	public, err := fs.Sub(embedded, "embedded/public")
+	if err != nil {
+		panic(err)
+	}
+	return public
+}
+
+func embeddedLocales() fs.FS {
+	locales, err := fs.Sub(embedded, "locales")
+	if err != nil {
+		panic(err)
+	}
+	return locales
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportVersion          = 2
+	exportManifestName     = "manifest.json"
+	exportTimeFormat       = "2006-01-02 15:04:05"
+	maxImportMemos         = 10000
+	maxImportMemoBytes     = 65535 // memos.content is a TEXT column
+	maxImportManifestBytes = 4 << 20
+	defaultMaxImportBytes  = 512 << 20
+)
+
+// ExportManifest describes the memos in an export archive. Each entry
+// points at a markdown file and the attached files in the same archive.
+// Version 1 archives have no attachments and no memo ids.
+type ExportManifest struct {
+	Version  int            `json:"version"`
+	Username string         `json:"username"`
+	Exported string         `json:"exported_at"`
+	Memos    []*ExportEntry `json:"memos"`
+}
+
+type ExportEntry struct {
+	Id        int           `json:"id"`
+	File      string        `json:"file"`
+	CreatedAt string        `json:"created_at"`
+	IsPrivate int           `json:"is_private"`
+	Tags      []string      `json:"tags"`
+	Files     []*ExportFile `json:"files"`
+}
+
+type ExportFile struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	ContentType string `json:"content_type"`
+}
+
+// memoFileLink matches links to the attachments of a memo, which have to
+// point at its new id once it is imported.
+var memoFileLink = regexp.MustCompile(`/memo/(\d+)/file/`)
+
+var hashtagRegexp = regexp.MustCompile(`(?:^|\s)#(\w+)`)
+
+// memoTags are the #hashtags written in a memo, in order of appearance.
+func memoTags(content string) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range hashtagRegexp.FindAllStringSubmatch(content, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			tags = append(tags, m[1])
+		}
+	}
+	return tags
+}
+
+func mypageExportHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+
+	user := getUser(w, r, dbConn, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	rows, err := dbConn.Query("SELECT id, content, is_private, created_at FROM memos WHERE user=? ORDER BY id", user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	memos := make(Memos, 0)
+	for rows.Next() {
+		memo := Memo{}
+		rows.Scan(&memo.Id, &memo.Content, &memo.IsPrivate, &memo.CreatedAt)
+		memos = append(memos, &memo)
+	}
+	rows.Close()
+	files, err := loadExportFiles(dbConn, user)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="memos-%d.zip"`, user.Id))
+	if err := writeExport(w, user, memos, files); err != nil {
+		log.Printf("export: %s", err)
+	}
+}
+
+// writeExport writes the archive of the memos of user and their files.
+// Memos hidden by an administrator and attachments that are gone from the
+// disk are left out.
+func writeExport(w io.Writer, user *User, memos Memos, files map[int][]*MemoFile) error {
+	manifest := &ExportManifest{
+		Version:  exportVersion,
+		Username: user.Username,
+		Exported: time.Now().Format(exportTimeFormat),
+		Memos:    make([]*ExportEntry, 0, len(memos)),
+	}
+	zw := zip.NewWriter(w)
+	for _, memo := range memos {
+		if memo.IsPrivate == visibilityHidden {
+			continue
+		}
+		entry := &ExportEntry{
+			Id:        memo.Id,
+			File:      fmt.Sprintf("memos/%d.md", memo.Id),
+			CreatedAt: memo.CreatedAt,
+			IsPrivate: memo.IsPrivate,
+			Tags:      memoTags(memo.Content),
+			Files:     make([]*ExportFile, 0),
+		}
+		f, err := zw.Create(entry.File)
+		if err != nil {
+			return err
+		}
+		io.WriteString(f, memo.Content)
+		for _, mf := range files[memo.Id] {
+			ef := &ExportFile{
+				Name:        mf.Name,
+				File:        fmt.Sprintf("files/%d/%s", memo.Id, mf.Name),
+				ContentType: mf.ContentType,
+			}
+			err := exportFile(zw, ef.File, attachmentDir(int64(memo.Id))+"/"+mf.Name)
+			if os.IsNotExist(err) {
+				log.Printf("export: %s", err)
+				continue
+			} else if err != nil {
+				return err
+			}
+			entry.Files = append(entry.Files, ef)
+		}
+		manifest.Memos = append(manifest.Memos, entry)
+	}
+	f, err := zw.Create(exportManifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func loadExportFiles(dbConn *sql.DB, user *User) (map[int][]*MemoFile, error) {
+	rows, err := dbConn.Query(
+		"SELECT memo_files.memo, memo_files.name, memo_files.content_type FROM memo_files JOIN memos ON (memo_files.memo = memos.id) WHERE memos.user=? ORDER BY memo_files.id",
+		user.Id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make(map[int][]*MemoFile)
+	for rows.Next() {
+		f := MemoFile{}
+		if err := rows.Scan(&f.Memo, &f.Name, &f.ContentType); err != nil {
+			return nil, err
+		}
+		files[f.Memo] = append(files[f.Memo], &f)
+	}
+	return files, rows.Err()
+}
+
+func exportFile(zw *zip.Writer, name string, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// importError is what is wrong with an uploaded archive, as a catalog key
+// so the user is told in their language.
+type importError struct {
+	key  string
+	args []interface{}
+}
+
+func newImportError(key string, args ...interface{}) error {
+	return &importError{key: key, args: args}
+}
+
+func (e *importError) Error() string {
+	return translate(defaultLocale, e.key, e.args...)
+}
+
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, newImportError("import.too_large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, newImportError("import.too_large", f.Name)
+	}
+	return data, nil
+}
+
+// readExport checks an archive made by mypageExportHandler and returns its
+// manifest with the memo contents and the attached files keyed by file name.
+// The attachments are only read when they are imported.
+func readExport(zr *zip.Reader) (*ExportManifest, map[string]string, map[string]*zip.File, error) {
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	mf, ok := files[exportManifestName]
+	if !ok {
+		return nil, nil, nil, newImportError("import.missing", exportManifestName)
+	}
+	data, err := readZipFile(mf, maxImportManifestBytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	manifest := &ExportManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, nil, nil, newImportError("import.broken", exportManifestName, err)
+	}
+	if manifest.Version < 1 || manifest.Version > exportVersion {
+		return nil, nil, nil, newImportError("import.version", manifest.Version)
+	}
+	if len(manifest.Memos) > maxImportMemos {
+		return nil, nil, nil, newImportError("import.too_many_memos", maxImportMemos)
+	}
+	// every file is read once at most, and all of them together unpack to
+	// maxImportBytes at most
+	used := map[string]bool{exportManifestName: true}
+	total := mf.UncompressedSize64
+	claim := func(name string) (*zip.File, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, newImportError("import.missing", name)
+		}
+		if used[name] {
+			return nil, newImportError("import.reused", name)
+		}
+		used[name] = true
+		if total += f.UncompressedSize64; total > uint64(maxImportBytes()) {
+			return nil, newImportError("import.total_too_large", maxImportBytes()>>20)
+		}
+		return f, nil
+	}
+	contents := make(map[string]string)
+	attachments := make(map[string]*zip.File)
+	for _, entry := range manifest.Memos {
+		f, err := claim(entry.File)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		data, err := readZipFile(f, maxImportMemoBytes)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		contents[entry.File] = string(data)
+		if len(entry.Files) > maxAttachments {
+			return nil, nil, nil, newImportError("import.too_many_files", entry.File)
+		}
+		for _, ef := range entry.Files {
+			f, err := claim(ef.File)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if f.UncompressedSize64 > uint64(maxUploadBytes()) {
+				return nil, nil, nil, newImportError("import.too_large", ef.File)
+			}
+			attachments[ef.File] = f
+		}
+	}
+	return manifest, contents, attachments, nil
+}
+
+// maxImportBytes is how large an archive can be, and how much it may
+// unpack to. It is also the request body limit of /mypage/import.
+func maxImportBytes() int64 {
+	if config.MaxImportBytes > 0 {
+		return config.MaxImportBytes
+	}
+	return defaultMaxImportBytes
+}
+
+func mypageImportHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+
+	user := getUser(w, r, dbConn, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	imported := 0
+	file, header, err := r.FormFile("archive")
+	if err == nil {
+		defer file.Close()
+		var zr *zip.Reader
+		zr, err = zip.NewReader(file, header.Size)
+		if err == nil {
+			var manifest *ExportManifest
+			var contents map[string]string
+			var attachments map[string]*zip.File
+			manifest, contents, attachments, err = readExport(zr)
+			if err == nil {
+				imported, err = importMemos(dbConn, user, manifest, contents, attachments)
+			}
+		}
+	}
+	locale := requestLocale(r, user)
+	if ie, ok := err.(*importError); ok {
+		addFlash(session, FlashError, translate(locale, "flash.import_failed", translate(locale, ie.key, ie.args...)))
+	} else if err != nil {
+		addFlash(session, FlashError, translate(locale, "flash.import_failed", err.Error()))
+	} else {
+		addFlash(session, FlashInfo, translate(locale, "flash.imported", imported))
+	}
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
+
+// importVisibility is the visibility of an imported memo, private unless
+// the archive says public or unlisted.
+func importVisibility(isPrivate int) int {
+	switch isPrivate {
+	case visibilityPublic, visibilityUnlisted:
+		return isPrivate
+	}
+	return visibilityPrivate
+}
+
+// importMemos writes the memos of an archive in one transaction and returns
+// how many there were. Memos hidden by an administrator, which older
+// archives have, are skipped: importing them would undo the hiding. Links
+// to the files of the archived memos are rewritten to the new ids at the
+// end.
+func importMemos(dbConn *sql.DB, user *User, manifest *ExportManifest, contents map[string]string, attachments map[string]*zip.File) (int, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	newIds := make(map[string]int64)
+	entries := make([]*ExportEntry, 0, len(manifest.Memos))
+	memoIds := make([]int64, 0, len(manifest.Memos))
+	fail := func(err error) (int, error) {
+		tx.Rollback()
+		for _, memoId := range memoIds {
+			removeAttachments(memoId)
+		}
+		return 0, err
+	}
+	for _, entry := range manifest.Memos {
+		if entry.IsPrivate == visibilityHidden {
+			continue
+		}
+		createdAt := strings.TrimSpace(entry.CreatedAt)
+		if _, err := time.Parse(exportTimeFormat, createdAt); err != nil {
+			createdAt = time.Now().Format(exportTimeFormat)
+		}
+		isPrivate := importVisibility(entry.IsPrivate)
+		result, err := tx.Exec(
+			"INSERT INTO memos (user, content, is_private, created_at) VALUES (?, ?, ?, ?)",
+			user.Id, contents[entry.File], isPrivate, createdAt,
+		)
+		if err != nil {
+			return fail(err)
+		}
+		memoId, _ := result.LastInsertId()
+		entries = append(entries, entry)
+		memoIds = append(memoIds, memoId)
+		if 0 < entry.Id {
+			newIds[strconv.Itoa(entry.Id)] = memoId
+		}
+		if isPrivate == visibilityUnlisted {
+			if _, err := tx.Exec("INSERT IGNORE INTO memo_shares (memo, token) VALUES (?, ?)", memoId, newShareToken()); err != nil {
+				return fail(err)
+			}
+		}
+		for _, ef := range entry.Files {
+			src, err := attachments[ef.File].Open()
+			if err == nil {
+				err = addAttachment(tx, memoId, ef.Name, src)
+				src.Close()
+			}
+			if err != nil {
+				return fail(err)
+			}
+		}
+	}
+	for i, entry := range entries {
+		content := contents[entry.File]
+		rewritten := memoFileLink.ReplaceAllStringFunc(content, func(link string) string {
+			if memoId, ok := newIds[memoFileLink.FindStringSubmatch(link)[1]]; ok {
+				return fmt.Sprintf("/memo/%d/file/", memoId)
+			}
+			return link
+		})
+		if rewritten == content {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE memos SET content=? WHERE id=?", rewritten, memoIds[i]); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	pages.invalidate()
+	return len(entries), nil
+}
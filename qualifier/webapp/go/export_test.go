@@ -0,0 +1,346 @@
+package main
+
+import (
+	"./sessions"
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// importDB is the memos and files an import writes, behind a database/sql
+// driver that only knows the statements importMemos runs.
+type importDB struct {
+	nextId int64
+	memos  map[int64]*Memo
+	files  map[int64][]string
+}
+
+var testImportDB *importDB
+
+type importConn struct{}
+type importStmt struct{ query string }
+type importResult struct{ id int64 }
+
+func (importConn) Prepare(query string) (driver.Stmt, error) { return importStmt{query}, nil }
+func (importConn) Close() error                              { return nil }
+func (importConn) Begin() (driver.Tx, error)                 { return importConn{}, nil }
+func (importConn) Commit() error                             { return nil }
+func (importConn) Rollback() error                           { return nil }
+
+func (s importStmt) Close() error  { return nil }
+func (s importStmt) NumInput() int { return -1 }
+
+func (s importStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := testImportDB
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO memos "):
+		db.nextId++
+		db.memos[db.nextId] = &Memo{
+			Id:        int(db.nextId),
+			User:      int(args[0].(int64)),
+			Content:   args[1].(string),
+			IsPrivate: int(args[2].(int64)),
+		}
+		return importResult{db.nextId}, nil
+	case strings.HasPrefix(s.query, "INSERT INTO memo_files "):
+		memoId := args[0].(int64)
+		db.files[memoId] = append(db.files[memoId], args[1].(string))
+		return importResult{}, nil
+	case strings.HasPrefix(s.query, "UPDATE memos SET content=? "):
+		db.memos[args[1].(int64)].Content = args[0].(string)
+		return importResult{}, nil
+	case strings.HasPrefix(s.query, "INSERT IGNORE INTO memo_shares "):
+		return importResult{}, nil
+	}
+	return nil, fmt.Errorf("unexpected statement %q", s.query)
+}
+
+func (s importStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.HasSuffix(s.query, " FROM users WHERE id=?") {
+		return &importUserRows{[]driver.Value{args[0], "isucon7", "", "", nil, false, false, false, "en"}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+// importUserRows is the user getUser reads.
+type importUserRows struct {
+	values []driver.Value
+}
+
+func (r *importUserRows) Columns() []string {
+	return []string{"id", "username", "password", "salt", "last_access", "is_admin", "is_disabled", "must_reset_password", "locale"}
+}
+
+func (r *importUserRows) Close() error { return nil }
+
+func (r *importUserRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+func (r importResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r importResult) RowsAffected() (int64, error) { return 1, nil }
+
+type importDriver struct{}
+
+func (importDriver) Open(name string) (driver.Conn, error) { return importConn{}, nil }
+
+func init() {
+	sql.Register("importtest", importDriver{})
+}
+
+func newImportDB(t *testing.T) *sql.DB {
+	// memo ids of the imported copies don't collide with the exported ones
+	testImportDB = &importDB{nextId: 100, memos: make(map[int64]*Memo), files: make(map[int64][]string)}
+	dbConn, err := sql.Open("importtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbConn
+}
+
+func useTempDatadir(t *testing.T) {
+	old := config
+	config = &Config{Datadir: t.TempDir()}
+	t.Cleanup(func() { config = old })
+}
+
+// roundTrip exports memos with their files and imports the archive again.
+func roundTrip(t *testing.T, memos Memos, files map[int][]*MemoFile) *importDB {
+	user := &User{Id: 7, Username: "isucon7"}
+	buf := &bytes.Buffer{}
+	if err := writeExport(buf, user, memos, files); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, contents, attachments, err := readExport(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := importMemos(newImportDB(t), user, manifest, contents, attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != len(manifest.Memos) {
+		t.Errorf("imported %d memos, the archive has %d", imported, len(manifest.Memos))
+	}
+	return testImportDB
+}
+
+func TestExportImportAttachments(t *testing.T) {
+	useTempDatadir(t)
+	if err := os.MkdirAll(attachmentDir(1), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(attachmentDir(1)+"/notes.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	memos := Memos{
+		{Id: 1, Content: "[notes](attachment:notes.txt) [again](http://example.com/memo/1/file/notes.txt)", CreatedAt: "2013-10-05 10:00:00"},
+		{Id: 2, Content: "see /memo/1/file/notes.txt and /memo/99/file/other.txt", CreatedAt: "2013-10-05 11:00:00"},
+	}
+	files := map[int][]*MemoFile{
+		1: {{Memo: 1, Name: "notes.txt", ContentType: "text/plain; charset=utf-8"}},
+		// gone from the disk, left out of the archive
+		2: {{Memo: 2, Name: "lost.txt", ContentType: "text/plain; charset=utf-8"}},
+	}
+	db := roundTrip(t, memos, files)
+
+	if got := db.memos[101].Content; got != "[notes](attachment:notes.txt) [again](http://example.com/memo/101/file/notes.txt)" {
+		t.Errorf("memo 1 was imported as %q", got)
+	}
+	// memo 99 is not in the archive, its link is left alone
+	if got := db.memos[102].Content; got != "see /memo/101/file/notes.txt and /memo/99/file/other.txt" {
+		t.Errorf("memo 2 was imported as %q", got)
+	}
+	if got := db.files[101]; len(got) != 1 || got[0] != "notes.txt" {
+		t.Errorf("memo 1 was imported with files %v", got)
+	}
+	if got := db.files[102]; len(got) != 0 {
+		t.Errorf("memo 2 was imported with files %v", got)
+	}
+	data, err := ioutil.ReadFile(attachmentDir(101) + "/notes.txt")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("imported attachment is %q, %v", data, err)
+	}
+}
+
+func zipArchive(files map[string]string) *zip.Reader {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		f, _ := zw.Create(name)
+		io.WriteString(f, content)
+	}
+	zw.Close()
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	return zr
+}
+
+// importArchive imports an archive of the given files.
+func importArchive(t *testing.T, files map[string]string) (*importDB, int) {
+	manifest, contents, attachments, err := readExport(zipArchive(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := importMemos(newImportDB(t), &User{Id: 7}, manifest, contents, attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testImportDB, imported
+}
+
+func TestImportVersion1(t *testing.T) {
+	useTempDatadir(t)
+	db, _ := importArchive(t, map[string]string{
+		"memos/1.md":       "see /memo/1/file/a.png",
+		exportManifestName: `{"version": 1, "memos": [{"file": "memos/1.md", "created_at": "2013-10-05 10:00:00", "is_private": 1}]}`,
+	})
+	memo := db.memos[101]
+	if memo == nil || memo.Content != "see /memo/1/file/a.png" || memo.IsPrivate != visibilityPrivate {
+		t.Errorf("imported %+v", memo)
+	}
+}
+
+func TestExportImportHiddenMemo(t *testing.T) {
+	useTempDatadir(t)
+	memos := Memos{
+		{Id: 1, Content: "public", IsPrivate: visibilityPublic, CreatedAt: "2013-10-05 10:00:00"},
+		{Id: 2, Content: "hidden", IsPrivate: visibilityHidden, CreatedAt: "2013-10-05 11:00:00"},
+	}
+	db := roundTrip(t, memos, nil)
+	if len(db.memos) != 1 || db.memos[101] == nil || db.memos[101].Content != "public" {
+		for _, memo := range db.memos {
+			t.Errorf("imported %+v", memo)
+		}
+	}
+
+	// archives from before hidden memos were left out, or made by hand
+	db, imported := importArchive(t, map[string]string{
+		"memos/1.md": "hidden",
+		"memos/2.md": "unknown visibility",
+		exportManifestName: `{"version": 1, "memos": [
+			{"file": "memos/1.md", "created_at": "2013-10-05 10:00:00", "is_private": 3},
+			{"file": "memos/2.md", "created_at": "2013-10-05 11:00:00", "is_private": 7}
+		]}`,
+	})
+	if imported != 1 || len(db.memos) != 1 {
+		t.Fatalf("imported %d memos, %d written", imported, len(db.memos))
+	}
+	if memo := db.memos[101]; memo.Content != "unknown visibility" || memo.IsPrivate != visibilityPrivate {
+		t.Errorf("imported %+v", memo)
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	useTempDatadir(t)
+	config.MaxImportBytes = 2000
+	big := strings.Repeat("x", 500)
+	tests := []struct {
+		name     string
+		manifest string
+		key      string
+	}{
+		{"memo file twice", `{"version": 2, "memos": [{"file": "a"}, {"file": "a"}]}`, "import.reused"},
+		{"attachment twice", `{"version": 2, "memos": [
+			{"file": "a", "files": [{"name": "x", "file": "b"}]},
+			{"file": "c", "files": [{"name": "x", "file": "b"}]}
+		]}`, "import.reused"},
+		{"attachment is a memo", `{"version": 2, "memos": [{"file": "a", "files": [{"name": "x", "file": "a"}]}]}`, "import.reused"},
+		{"manifest as a memo", `{"version": 2, "memos": [{"file": "manifest.json"}]}`, "import.reused"},
+		{"unpacks too large", `{"version": 2, "memos": [
+			{"file": "a", "files": [{"name": "x", "file": "b"}, {"name": "y", "file": "c"}, {"name": "z", "file": "d"}]}
+		]}`, "import.total_too_large"},
+	}
+	for _, test := range tests {
+		_, _, _, err := readExport(zipArchive(map[string]string{"a": big, "b": big, "c": big, "d": big, exportManifestName: test.manifest}))
+		if ie, ok := err.(*importError); !ok || ie.key != test.key {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.key)
+		}
+	}
+}
+
+// TestImportLargerThanUploads round-trips an archive too large for the
+// other forms through the request body limits and mypageImportHandler.
+func TestImportLargerThanUploads(t *testing.T) {
+	useTempDatadir(t)
+	config.MaxUploadBytes = 4096
+	memos := Memos{}
+	files := map[int][]*MemoFile{}
+	for id := 1; id <= 3; id++ {
+		if err := os.MkdirAll(attachmentDir(int64(id)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// random, so the archive does not compress below the upload limit
+		data := make([]byte, 3000)
+		rand.Read(data)
+		if err := ioutil.WriteFile(attachmentDir(int64(id))+"/data.bin", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		memos = append(memos, &Memo{Id: id, Content: "memo", CreatedAt: "2013-10-05 10:00:00"})
+		files[id] = []*MemoFile{{Memo: id, Name: "data.bin", ContentType: "application/octet-stream"}}
+	}
+	archive := &bytes.Buffer{}
+	if err := writeExport(archive, &User{Id: 7, Username: "isucon7"}, memos, files); err != nil {
+		t.Fatal(err)
+	}
+	if int64(archive.Len()) <= maxUploadBytes() {
+		t.Fatalf("the archive has %d bytes, not more than %d", archive.Len(), maxUploadBytes())
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField(csrfFormField, testToken)
+	fw, _ := mw.CreateFormFile("archive", "export.zip")
+	fw.Write(archive.Bytes())
+	mw.Close()
+	post := func(path string, h http.Handler) *httptest.ResponseRecorder {
+		session, _ := sessions.NewCookieStore([]byte(sessionSecret)).New(newPostRequest(path, nil), sessionName)
+		session.Values[csrfTokenKey] = testToken
+		session.Values["user_id"] = 7
+		r := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewReader(body.Bytes()))
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		limitRequestBody(csrfProtect(h), maxUploadBytes()).ServeHTTP(w, withSession(r, session))
+		return w
+	}
+
+	if w := post("/memo", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("other forms: got %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	oldPool := dbConnPool
+	defer func() { dbConnPool = oldPool }()
+	dbConnPool = make(chan *sql.DB, 1)
+	dbConnPool <- newImportDB(t)
+	if w := post("/mypage/import", http.HandlerFunc(mypageImportHandler)); w.Code != http.StatusFound {
+		t.Fatalf("import: got %d", w.Code)
+	}
+	if len(testImportDB.memos) != 3 {
+		t.Errorf("imported %d memos, want 3", len(testImportDB.memos))
+	}
+	for id := range testImportDB.memos {
+		if got := testImportDB.files[id]; len(got) != 1 || got[0] != "data.bin" {
+			t.Errorf("memo %d was imported with files %v", id, got)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"./sessions"
+	"log"
+	"net/http"
+)
+
+type FlashLevel string
+
+const (
+	FlashInfo    FlashLevel = "info"
+	FlashWarning FlashLevel = "warning"
+	FlashError   FlashLevel = "error"
+)
+
+// display order of flashes, most severe first
+var flashLevels = []FlashLevel{FlashError, FlashWarning, FlashInfo}
+
+type Flash struct {
+	Level   FlashLevel
+	Message string
+}
+
+func flashKey(level FlashLevel) string {
+	return "_flash_" + string(level)
+}
+
+func flashClass(level FlashLevel) string {
+	switch level {
+	case FlashInfo:
+		return "alert alert-info"
+	case FlashError:
+		return "alert alert-error"
+	}
+	return "alert"
+}
+
+func addFlash(session *sessions.Session, level FlashLevel, message string) {
+	session.AddFlash(message, flashKey(level))
+}
+
+// popFlashes takes all pending flashes out of the session. The session is
+// saved only when something was taken, so pages without flashes stay cheap.
+func popFlashes(w http.ResponseWriter, r *http.Request, session *sessions.Session) []*Flash {
+	flashes := make([]*Flash, 0)
+	for _, level := range flashLevels {
+		for _, v := range session.Flashes(flashKey(level)) {
+			if message, ok := v.(string); ok {
+				flashes = append(flashes, &Flash{Level: level, Message: message})
+			}
+		}
+	}
+	if len(flashes) > 0 {
+		if err := session.Save(r, w); err != nil {
+			log.Printf("can't save session: %v", err)
+		}
+	}
+	return flashes
+}
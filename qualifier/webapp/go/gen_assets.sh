@@ -0,0 +1,19 @@
+#!/bin/sh
+# Copies the public files into embedded/ for go:embed, with gzip and
+# (when the brotli command is installed) brotli variants of text files.
+# Run through "go generate" before "go build".
+
+set -e
+cd $(dirname $0)
+
+rm -rf embedded
+mkdir -p embedded
+cp -RL public embedded/public
+
+find embedded/public -type f \( -name '*.css' -o -name '*.js' -o -name '*.html' -o -name '*.ico' -o -name '*.svg' -o -name '*.txt' \) |
+while read f; do
+    gzip -9 -n -c "$f" > "$f.gz"
+    if command -v brotli > /dev/null; then
+        brotli -q 11 -c "$f" > "$f.br"
+    fi
+done
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+// Catalog maps message keys to fmt formats in one language.
+type Catalog map[string]string
+
+// catalogs holds the loaded catalogs by locale, and locales lists them in
+// the order they are offered on mypage.
+var (
+	catalogs = make(map[string]Catalog)
+	locales  = make([]string, 0)
+)
+
+// loadCatalogs reads one <locale>.json catalog per locale from fsys.
+func loadCatalogs(fsys fs.FS) error {
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		catalog := make(Catalog)
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		locale := strings.TrimSuffix(path.Base(name), ".json")
+		catalogs[locale] = catalog
+		locales = append(locales, locale)
+	}
+	if _, ok := catalogs[defaultLocale]; !ok {
+		return fmt.Errorf("no catalog for the default locale %s", defaultLocale)
+	}
+	return nil
+}
+
+// translate formats the message for key in locale, falling back to the
+// default locale and then to the key itself.
+func translate(locale string, key string, args ...interface{}) string {
+	format, ok := catalogs[locale][key]
+	if !ok {
+		if format, ok = catalogs[defaultLocale][key]; !ok {
+			format = key
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func supportedLocale(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok
+}
+
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// negotiateLocale picks the best supported locale from Accept-Language.
+// "ja-JP" is matched by the "ja" catalog.
+func negotiateLocale(acceptLanguage string) string {
+	ranges := make([]languageRange, 0)
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, languageRange{tag, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	for _, lr := range ranges {
+		if lr.tag == "*" {
+			return defaultLocale
+		}
+		if supportedLocale(lr.tag) {
+			return lr.tag
+		}
+		if i := strings.Index(lr.tag, "-"); i > 0 && supportedLocale(lr.tag[:i]) {
+			return lr.tag[:i]
+		}
+	}
+	return defaultLocale
+}
+
+// requestLocale is the signed-in user's choice if they made one, and what
+// the browser asks for otherwise.
+func requestLocale(r *http.Request, user *User) string {
+	if user != nil && supportedLocale(user.Locale) {
+		return user.Locale
+	}
+	return negotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+func localeHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	// an empty locale goes back to following the browser
+	locale := r.FormValue("locale")
+	if locale != "" && !supportedLocale(locale) {
+		locale = ""
+	}
+	if _, err := dbConn.Exec("UPDATE users SET locale=? WHERE id=?", locale, user.Id); err != nil {
+		serverError(w, err)
+		return
+	}
+	if locale == "" {
+		locale = negotiateLocale(r.Header.Get("Accept-Language"))
+	}
+	addFlash(session, FlashInfo, translate(locale, "flash.locale_updated"))
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
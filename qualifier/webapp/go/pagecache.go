@@ -0,0 +1,183 @@
+package main
+
+import (
+	"./sessions"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const pageCacheMaxEntries = 10000
+
+// cachedPage is a rendered page as an anonymous visitor sees it. gen is the
+// cache generation the page was rendered in.
+type cachedPage struct {
+	gen         uint64
+	contentType string
+	etag        string
+	body        []byte
+}
+
+// pageCache holds full pages for visitors without a user_id. Anything that
+// changes what anonymous visitors see calls invalidate, which starts a new
+// generation and so drops every page at once.
+type pageCache struct {
+	mu      sync.RWMutex
+	gen     uint64
+	entries map[string]*cachedPage
+}
+
+var pages = &pageCache{entries: make(map[string]*cachedPage)}
+
+func (c *pageCache) generation() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.gen
+}
+
+func (c *pageCache) get(key string) *cachedPage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if p, ok := c.entries[key]; ok && p.gen == c.gen {
+		return p
+	}
+	return nil
+}
+
+// put stores a page rendered in generation gen, unless the cache was
+// invalidated while it was being rendered.
+func (c *pageCache) put(key string, p *cachedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.gen != c.gen {
+		return
+	}
+	if len(c.entries) >= pageCacheMaxEntries {
+		c.entries = make(map[string]*cachedPage)
+	}
+	c.entries[key] = p
+}
+
+func (c *pageCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[string]*cachedPage)
+}
+
+func isAnonymous(session *sessions.Session) bool {
+	if session.Values["user_id"] != nil {
+		return false
+	}
+	// a pending flash makes the page personal
+	for _, level := range flashLevels {
+		if session.Values[flashKey(level)] != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// pageRecorder buffers a response so it can be cached before it is sent.
+type pageRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *pageRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *pageRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *pageRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+func servePage(w http.ResponseWriter, r *http.Request, p *cachedPage, hit bool) {
+	h := w.Header()
+	h.Set("Content-Type", p.contentType)
+	h.Set("ETag", p.etag)
+	// the same URL is personal once signed in, see getUser
+	h.Set("Cache-Control", "public, no-cache")
+	addVary(h, "Cookie")
+	addVary(h, "Accept-Language")
+	if hit {
+		h.Set("X-Page-Cache", "HIT")
+	} else {
+		h.Set("X-Page-Cache", "MISS")
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), p.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(p.body)
+}
+
+// etagMatch compares weakly, because compressHandler marks the ETags of
+// the pages it compresses as weak.
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cachePage serves anonymous GETs of h from the page cache. Pages are keyed
+// by base URL too, because links in them are absolute, and by the locale
+// negotiated from Accept-Language.
+func cachePage(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// in dev mode template edits have to show up right away
+		if config.DevMode || (r.Method != "GET" && r.Method != "HEAD") {
+			h(w, r)
+			return
+		}
+		session, err := loadSession(w, r)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		r = withSession(r, session)
+		if !isAnonymous(session) {
+			h(w, r)
+			return
+		}
+		key := negotiateLocale(r.Header.Get("Accept-Language")) + " " + requestBaseUrl(r).String() + r.URL.RequestURI()
+		if p := pages.get(key); p != nil {
+			servePage(w, r, p, true)
+			return
+		}
+
+		gen := pages.generation()
+		rec := &pageRecorder{header: make(http.Header), status: http.StatusOK}
+		h(rec, r)
+		if rec.status == http.StatusOK && r.Method == "GET" && rec.header.Get("Set-Cookie") == "" {
+			p := &cachedPage{
+				gen:         gen,
+				contentType: rec.header.Get("Content-Type"),
+				etag:        fmt.Sprintf(`"%x"`, sha1.Sum(rec.body.Bytes())),
+				body:        rec.body.Bytes(),
+			}
+			if p.contentType == "" {
+				p.contentType = http.DetectContentType(p.body)
+			}
+			pages.put(key, p)
+			servePage(w, r, p, false)
+			return
+		}
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"net/http"
+)
+
+const (
+	resetUserKey      = "reset_user_id"
+	minPasswordLength = 8
+)
+
+func hashPassword(salt string, password string) string {
+	h := sha256.New()
+	h.Write([]byte(salt + password))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func newSalt() string {
+	return fmt.Sprintf("%x", securecookie.GenerateRandomKey(16))
+}
+
+// passwordHandler is where signin sends users whose password was reset by
+// an admin. They are not signed in until they choose a new one.
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	baseUrl := prepareHandler(w, r)
+	if session.Values[resetUserKey] == nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	v := &View{
+		BaseUrl: baseUrl,
+		Locale:  requestLocale(r, nil),
+		Session: session,
+		Flashes: popFlashes(w, r, session),
+	}
+	if err := tmpl.ExecuteTemplate(w, "password", v); err != nil {
+		serverError(w, err)
+	}
+}
+
+func passwordPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	userId := session.Values[resetUserKey]
+	if userId == nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+
+	locale := requestLocale(r, nil)
+	password := r.FormValue("password")
+	switch {
+	case len(password) < minPasswordLength:
+		addFlash(session, FlashError, translate(locale, "flash.password_too_short", minPasswordLength))
+	case password != r.FormValue("password_confirm"):
+		addFlash(session, FlashError, translate(locale, "flash.password_mismatch"))
+	default:
+		salt := newSalt()
+		if _, err := dbConn.Exec(
+			"UPDATE users SET password=?, salt=?, must_reset_password=0, last_access=now() WHERE id=?",
+			hashPassword(salt, password), salt, userId,
+		); err != nil {
+			serverError(w, err)
+			return
+		}
+		delete(session.Values, resetUserKey)
+		session.Values["user_id"] = userId
+		session.Values[csrfTokenKey] = newCSRFToken()
+		addFlash(session, FlashInfo, translate(locale, "flash.password_changed"))
+		if err := session.Save(r, w); err != nil {
+			serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/mypage", http.StatusFound)
+		return
+	}
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/password", http.StatusFound)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type TrustedProxies []*net.IPNet
+
+func parseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, ipnet)
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range t {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedElement is one comma separated element of a Forwarded header
+// (RFC 7239).
+type forwardedElement struct {
+	For   string
+	Host  string
+	Proto string
+}
+
+func parseForwarded(values []string) []forwardedElement {
+	elements := make([]forwardedElement, 0)
+	for _, value := range values {
+		for _, e := range strings.Split(value, ",") {
+			var elem forwardedElement
+			for _, pair := range strings.Split(e, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				v := strings.Trim(kv[1], `"`)
+				switch strings.ToLower(kv[0]) {
+				case "for":
+					elem.For = stripPort(v)
+				case "host":
+					elem.Host = v
+				case "proto":
+					elem.Proto = strings.ToLower(v)
+				}
+			}
+			elements = append(elements, elem)
+		}
+	}
+	return elements
+}
+
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+func splitHeader(values []string) []string {
+	list := make([]string, 0)
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+	}
+	return list
+}
+
+func lastValue(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[len(list)-1]
+}
+
+// forwardedBy walks the Forwarded elements from the nearest proxy outwards
+// while they were written by trusted proxies, and returns the outermost
+// one. Elements further left could have been made up by the client.
+func (t TrustedProxies) forwardedBy(elements []forwardedElement) (forwardedElement, bool) {
+	for i := len(elements) - 1; i >= 0; i-- {
+		if i == 0 || !t.contains(elements[i].For) {
+			return elements[i], true
+		}
+	}
+	return forwardedElement{}, false
+}
+
+func (t TrustedProxies) fromProxy(r *http.Request) bool {
+	return t.contains(stripPort(r.RemoteAddr))
+}
+
+// requestBaseUrl is the scheme and host the client used to reach us.
+// Forwarding headers are only believed when the peer is a trusted proxy.
+func requestBaseUrl(r *http.Request) *url.URL {
+	u := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if !trustedProxies.fromProxy(r) {
+		return u
+	}
+	if elem, ok := trustedProxies.forwardedBy(parseForwarded(r.Header["Forwarded"])); ok {
+		if elem.Host != "" {
+			u.Host = elem.Host
+		}
+		if elem.Proto == "http" || elem.Proto == "https" {
+			u.Scheme = elem.Proto
+		}
+		return u
+	}
+	if h := lastValue(splitHeader(r.Header["X-Forwarded-Host"])); h != "" {
+		u.Host = h
+	}
+	if p := strings.ToLower(lastValue(splitHeader(r.Header["X-Forwarded-Proto"]))); p == "http" || p == "https" {
+		u.Scheme = p
+	}
+	return u
+}
+
+// clientIP is the address of the client, skipping over trusted proxies.
+func clientIP(r *http.Request) string {
+	ip := stripPort(r.RemoteAddr)
+	if !trustedProxies.contains(ip) {
+		return ip
+	}
+	if elements := parseForwarded(r.Header["Forwarded"]); len(elements) > 0 {
+		for i := len(elements) - 1; i >= 0; i-- {
+			if elements[i].For == "" {
+				break
+			}
+			ip = elements[i].For
+			if !trustedProxies.contains(ip) {
+				break
+			}
+		}
+		return ip
+	}
+	list := splitHeader(r.Header["X-Forwarded-For"])
+	for i := len(list) - 1; i >= 0; i-- {
+		ip = stripPort(list[i])
+		if !trustedProxies.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUserBurst         = 10
+	defaultUserRate          = 1.0
+	defaultIPBurst           = 30
+	defaultIPRate            = 5.0
+	defaultLockoutThreshold  = 5
+	defaultLockoutSeconds    = 30
+	defaultMaxLockoutSeconds = 3600
+	casRetries               = 10
+	// the memory store keeps this many keys at most, the least recently
+	// used go first, and drops the expired ones every sweep interval
+	maxMemoryLimitEntries = 100000
+	limitSweepInterval    = time.Minute
+)
+
+type RateLimitConfig struct {
+	Backend           string  `json:"backend"`
+	UserBurst         int     `json:"user_burst"`
+	UserRate          float64 `json:"user_rate"`
+	IPBurst           int     `json:"ip_burst"`
+	IPRate            float64 `json:"ip_rate"`
+	LockoutThreshold  int     `json:"lockout_threshold"`
+	LockoutSeconds    int     `json:"lockout_seconds"`
+	MaxLockoutSeconds int     `json:"max_lockout_seconds"`
+}
+
+// limitState is a token bucket plus the consecutive failure count. Buckets
+// keyed by IP only use the token part. Once Expires has passed the state is
+// as good as a missing one and the store may drop it.
+type limitState struct {
+	Tokens      float64   `json:"tokens"`
+	Updated     time.Time `json:"updated"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	Expires     time.Time `json:"expires"`
+}
+
+// limitStore applies fn to the state stored under key atomically. A missing
+// key starts from a zero limitState.
+type limitStore interface {
+	update(key string, fn func(st *limitState)) (limitState, error)
+}
+
+type memoryLimitEntry struct {
+	key   string
+	state limitState
+}
+
+type memoryLimitStore struct {
+	mu        sync.Mutex
+	max       int
+	entries   map[string]*list.Element
+	lru       *list.List
+	nextSweep time.Time
+}
+
+func newMemoryLimitStore(max int) *memoryLimitStore {
+	return &memoryLimitStore{max: max, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *memoryLimitStore) update(key string, fn func(st *limitState)) (limitState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		s.sweep(now)
+		s.nextSweep = now.Add(limitSweepInterval)
+	}
+	el, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	} else {
+		el = s.lru.PushFront(&memoryLimitEntry{key: key})
+		s.entries[key] = el
+		if s.lru.Len() > s.max {
+			s.remove(s.lru.Back())
+		}
+	}
+	e := el.Value.(*memoryLimitEntry)
+	if now.After(e.state.Expires) {
+		e.state = limitState{}
+	}
+	fn(&e.state)
+	return e.state, nil
+}
+
+func (s *memoryLimitStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*memoryLimitEntry).key)
+}
+
+func (s *memoryLimitStore) sweep(now time.Time) {
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*memoryLimitEntry).state.Expires) {
+			s.remove(el)
+		}
+		el = prev
+	}
+}
+
+// memcacheClient is the part of *memcache.Client the store uses.
+type memcacheClient interface {
+	Get(key string) (*memcache.Item, error)
+	Add(item *memcache.Item) error
+	CompareAndSwap(item *memcache.Item) error
+}
+
+type memcacheLimitStore struct {
+	client memcacheClient
+}
+
+func newMemcacheLimitStore(server string) *memcacheLimitStore {
+	return &memcacheLimitStore{client: memcache.New(server)}
+}
+
+func (s *memcacheLimitStore) update(key string, fn func(st *limitState)) (limitState, error) {
+	for i := 0; i < casRetries; i++ {
+		var st limitState
+		item, err := s.client.Get(key)
+		if err == memcache.ErrCacheMiss {
+			item = nil
+		} else if err != nil {
+			return st, err
+		} else if err := json.Unmarshal(item.Value, &st); err != nil {
+			st = limitState{}
+		}
+		fn(&st)
+		value, err := json.Marshal(&st)
+		if err != nil {
+			return st, err
+		}
+		// memcached takes whole seconds, and 0 would keep it forever
+		expiration := int32(time.Until(st.Expires)/time.Second) + 1
+		if item == nil {
+			err = s.client.Add(&memcache.Item{Key: key, Value: value, Expiration: expiration})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+		} else {
+			item.Value = value
+			item.Expiration = expiration
+			err = s.client.CompareAndSwap(item)
+			if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+				continue
+			}
+		}
+		return st, err
+	}
+	return limitState{}, fmt.Errorf("ratelimit: too much contention on %s", key)
+}
+
+type loginLimiter struct {
+	store            limitStore
+	userBurst        float64
+	userRate         float64
+	ipBurst          float64
+	ipRate           float64
+	lockoutThreshold int
+	lockoutBase      time.Duration
+	lockoutMax       time.Duration
+}
+
+func newLoginLimiter(c RateLimitConfig) *loginLimiter {
+	l := &loginLimiter{
+		userBurst:        float64(c.UserBurst),
+		userRate:         c.UserRate,
+		ipBurst:          float64(c.IPBurst),
+		ipRate:           c.IPRate,
+		lockoutThreshold: c.LockoutThreshold,
+		lockoutBase:      time.Duration(c.LockoutSeconds) * time.Second,
+		lockoutMax:       time.Duration(c.MaxLockoutSeconds) * time.Second,
+	}
+	if l.userBurst <= 0 {
+		l.userBurst = defaultUserBurst
+	}
+	if l.userRate <= 0 {
+		l.userRate = defaultUserRate
+	}
+	if l.ipBurst <= 0 {
+		l.ipBurst = defaultIPBurst
+	}
+	if l.ipRate <= 0 {
+		l.ipRate = defaultIPRate
+	}
+	if l.lockoutThreshold <= 0 {
+		l.lockoutThreshold = defaultLockoutThreshold
+	}
+	if l.lockoutBase <= 0 {
+		l.lockoutBase = defaultLockoutSeconds * time.Second
+	}
+	if l.lockoutMax <= 0 {
+		l.lockoutMax = defaultMaxLockoutSeconds * time.Second
+	}
+	switch c.Backend {
+	case "memcached":
+		l.store = newMemcacheLimitStore(memcachedServer)
+	default:
+		l.store = newMemoryLimitStore(maxMemoryLimitEntries)
+	}
+	return l
+}
+
+func limitKey(kind string, value string) string {
+	// usernames are arbitrary bytes, memcached keys are not
+	return fmt.Sprintf("login_%s_%x", kind, sha256.Sum256([]byte(value)))
+}
+
+// take refills the bucket for the time passed since the last call and
+// takes one token from it. It returns how long to wait when it is empty.
+func take(st *limitState, burst float64, rate float64, now time.Time) time.Duration {
+	if st.Updated.IsZero() {
+		st.Tokens = burst
+	} else {
+		st.Tokens = math.Min(burst, st.Tokens+now.Sub(st.Updated).Seconds()*rate)
+	}
+	st.Updated = now
+	if st.Tokens < 1 {
+		return time.Duration((1 - st.Tokens) / rate * float64(time.Second))
+	}
+	st.Tokens--
+	return 0
+}
+
+// expire sets when st can be forgotten: the bucket is full again, the
+// lockout is over, and failures are kept for as long as the longest lockout
+// so that the next lockouts still grow.
+func (l *loginLimiter) expire(st *limitState, burst float64, rate float64, now time.Time) {
+	st.Expires = now.Add(time.Duration(math.Max(0, burst-st.Tokens) / rate * float64(time.Second)))
+	if st.Failures > 0 && st.Expires.Before(now.Add(l.lockoutMax)) {
+		st.Expires = now.Add(l.lockoutMax)
+	}
+	if st.Expires.Before(st.LockedUntil) {
+		st.Expires = st.LockedUntil
+	}
+}
+
+// allow returns a positive duration when the attempt must be refused,
+// either because the account is locked out or a bucket is empty.
+func (l *loginLimiter) allow(username string, ip string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	_, err := l.store.update(limitKey("ip", ip), func(st *limitState) {
+		wait = take(st, l.ipBurst, l.ipRate, now)
+		l.expire(st, l.ipBurst, l.ipRate, now)
+	})
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	_, err = l.store.update(limitKey("user", username), func(st *limitState) {
+		if now.Before(st.LockedUntil) {
+			wait = st.LockedUntil.Sub(now)
+		} else {
+			wait = take(st, l.userBurst, l.userRate, now)
+		}
+		l.expire(st, l.userBurst, l.userRate, now)
+	})
+	return wait, err
+}
+
+func (l *loginLimiter) failed(username string) error {
+	now := time.Now()
+	_, err := l.store.update(limitKey("user", username), func(st *limitState) {
+		st.Failures++
+		if st.Failures >= l.lockoutThreshold {
+			lockout := l.lockoutMax
+			if n := uint(st.Failures - l.lockoutThreshold); n < 32 {
+				if d := l.lockoutBase << n; d > 0 && d < l.lockoutMax {
+					lockout = d
+				}
+			}
+			st.LockedUntil = now.Add(lockout)
+		}
+		l.expire(st, l.userBurst, l.userRate, now)
+	})
+	return err
+}
+
+func (l *loginLimiter) succeeded(username string) error {
+	now := time.Now()
+	_, err := l.store.update(limitKey("user", username), func(st *limitState) {
+		st.Failures = 0
+		st.LockedUntil = time.Time{}
+		l.expire(st, l.userBurst, l.userRate, now)
+	})
+	return err
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"./sessions"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimitStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := newMemoryLimitStore(3)
+	keep := func(st *limitState) {
+		st.Failures++
+		st.Expires = time.Now().Add(time.Hour)
+	}
+	for _, key := range []string{"a", "b", "c", "a", "d"} {
+		s.update(key, keep)
+	}
+	if len(s.entries) != 3 || s.lru.Len() != 3 {
+		t.Fatalf("%d entries, %d in the list, want 3", len(s.entries), s.lru.Len())
+	}
+	if _, ok := s.entries["b"]; ok {
+		t.Error("b was used least recently but kept")
+	}
+	if st, _ := s.update("a", func(*limitState) {}); st.Failures != 2 {
+		t.Errorf("a has %d failures, want 2", st.Failures)
+	}
+}
+
+func TestMemoryLimitStoreForgetsExpired(t *testing.T) {
+	s := newMemoryLimitStore(100)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		s.update(fmt.Sprint(i), func(st *limitState) {
+			st.Failures = 1
+			st.Expires = now.Add(time.Duration(i-5) * time.Minute)
+		})
+	}
+	// an expired state is not used even before it is swept
+	if st, _ := s.update("0", func(*limitState) {}); st.Failures != 0 {
+		t.Errorf("expired state has %d failures", st.Failures)
+	}
+	s.sweep(now)
+	if len(s.entries) != 5 || s.lru.Len() != 5 {
+		t.Errorf("%d entries, %d in the list after the sweep, want 5", len(s.entries), s.lru.Len())
+	}
+
+	// sweeps run once an interval, not on every update
+	s.update("x", func(st *limitState) { st.Expires = now.Add(-time.Minute) })
+	s.update("y", func(st *limitState) { st.Expires = now.Add(time.Minute) })
+	if _, ok := s.entries["x"]; !ok {
+		t.Error("swept again before the interval was over")
+	}
+}
+
+func TestLimitStateExpires(t *testing.T) {
+	l := newLoginLimiter(RateLimitConfig{UserBurst: 10, UserRate: 2, MaxLockoutSeconds: 600})
+	now := time.Now()
+	tests := []struct {
+		st   limitState
+		want time.Duration
+	}{
+		{limitState{Tokens: 10}, 0},
+		{limitState{Tokens: 4}, 3 * time.Second},
+		{limitState{Tokens: 4, Failures: 1}, 600 * time.Second},
+		{limitState{Tokens: 10, Failures: 7, LockedUntil: now.Add(time.Hour)}, time.Hour},
+	}
+	for _, test := range tests {
+		st := test.st
+		l.expire(&st, l.userBurst, l.userRate, now)
+		if got := st.Expires.Sub(now); got != test.want {
+			t.Errorf("%+v expires after %v, want %v", test.st, got, test.want)
+		}
+	}
+}
+
+func TestTakeRefills(t *testing.T) {
+	now := time.Now()
+	st := &limitState{}
+	for i := 0; i < 3; i++ {
+		if wait := take(st, 3, 2, now); wait != 0 {
+			t.Fatalf("take %d of a full bucket waits %v", i, wait)
+		}
+	}
+	tests := []struct {
+		after time.Duration
+		wait  time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		// half a token is back
+		{250 * time.Millisecond, 250 * time.Millisecond},
+		{500 * time.Millisecond, 0},
+		{500 * time.Millisecond, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if wait := take(st, 3, 2, now.Add(test.after)); wait != test.wait {
+			t.Errorf("after %v: waits %v, want %v", test.after, wait, test.wait)
+		}
+	}
+	// a long pause fills it up to burst, no more
+	take(st, 3, 2, now.Add(time.Hour))
+	if st.Tokens != 2 {
+		t.Errorf("%v tokens left after a long pause, want 2", st.Tokens)
+	}
+}
+
+func TestLockoutGrows(t *testing.T) {
+	l := newLoginLimiter(RateLimitConfig{UserBurst: 100, LockoutThreshold: 3, LockoutSeconds: 10, MaxLockoutSeconds: 60})
+	for i, want := range []time.Duration{0, 0, 10, 20, 40, 60, 60} {
+		if err := l.failed("isucon1"); err != nil {
+			t.Fatal(err)
+		}
+		wait, err := l.allow("isucon1", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want *= time.Second; wait > want || wait < want-time.Second {
+			t.Errorf("after %d failures: waits %v, want %v", i+1, wait, want)
+		}
+	}
+
+	// the shift must not overflow into a short lockout
+	l.store.update(limitKey("user", "isucon1"), func(st *limitState) { st.Failures = 100 })
+	l.failed("isucon1")
+	if wait, _ := l.allow("isucon1", "192.0.2.1"); wait < 59*time.Second {
+		t.Errorf("after 101 failures: waits %v", wait)
+	}
+
+	l.succeeded("isucon1")
+	if wait, _ := l.allow("isucon1", "192.0.2.1"); wait != 0 {
+		t.Errorf("after signing in: waits %v", wait)
+	}
+	l.failed("isucon1")
+	if wait, _ := l.allow("isucon1", "192.0.2.1"); wait != 0 {
+		t.Errorf("first failure after signing in: waits %v", wait)
+	}
+}
+
+func TestSigninTooManyRequests(t *testing.T) {
+	form := url.Values{"username": {"isucon1"}, "password": {"isucon1"}}
+	signedIn := func() { signin(newSigninSession(), form) }
+	tests := []struct {
+		name       string
+		config     RateLimitConfig
+		prepare    func()
+		retryAfter string
+	}{
+		{"user bucket", RateLimitConfig{UserBurst: 1, UserRate: 0.25}, signedIn, "4"},
+		// the ip bucket is taken from first
+		{"ip bucket", RateLimitConfig{IPBurst: 1, IPRate: 0.5, UserBurst: 1}, signedIn, "2"},
+		{"lockout", RateLimitConfig{}, func() {
+			for i := 0; i < defaultLockoutThreshold; i++ {
+				limiter.failed("isucon1")
+			}
+		}, "30"},
+	}
+	for _, test := range tests {
+		useSigninDB(t, &signinDB{password: "isucon1"})
+		limiter = newLoginLimiter(test.config)
+		test.prepare()
+		w := signin(newSigninSession(), form)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("%s: got %d with Retry-After %q, want %d with %q", test.name, w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests, test.retryAfter)
+		}
+	}
+}
+
+func newSigninSession() *sessions.Session {
+	session, _ := sessions.NewCookieStore([]byte(sessionSecret)).New(newPostRequest("/signin", nil), sessionName)
+	return session
+}
+
+// fakeMemcache keeps items in a map. Before each of the first conflicts
+// writes another client gets in first: it adds other or changes the item.
+type fakeMemcache struct {
+	items     map[string][]byte
+	conflicts int
+	other     limitState
+	getErr    error
+}
+
+func (m *fakeMemcache) Get(key string) (*memcache.Item, error) {
+	if m.getErr != nil {
+		return nil, m.getErr
+	}
+	value, ok := m.items[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	return &memcache.Item{Key: key, Value: value}, nil
+}
+
+func (m *fakeMemcache) Add(item *memcache.Item) error {
+	if m.conflicts > 0 {
+		m.conflicts--
+		m.items[item.Key], _ = json.Marshal(&m.other)
+	}
+	if _, ok := m.items[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	return m.write(item)
+}
+
+func (m *fakeMemcache) CompareAndSwap(item *memcache.Item) error {
+	if m.conflicts > 0 {
+		m.conflicts--
+		return memcache.ErrCASConflict
+	}
+	return m.write(item)
+}
+
+func (m *fakeMemcache) write(item *memcache.Item) error {
+	if item.Expiration <= 0 {
+		return fmt.Errorf("%s would be kept forever", item.Key)
+	}
+	m.items[item.Key] = item.Value
+	return nil
+}
+
+func TestMemcacheLimitStoreRetries(t *testing.T) {
+	fail := func(st *limitState) {
+		st.Failures++
+		st.Expires = time.Now().Add(time.Minute)
+	}
+	stored := func(m *fakeMemcache) int {
+		st := limitState{}
+		json.Unmarshal(m.items["k"], &st)
+		return st.Failures
+	}
+	tests := []struct {
+		name      string
+		items     map[string][]byte
+		conflicts int
+		calls     int
+		failures  int
+	}{
+		{"new key", map[string][]byte{}, 0, 1, 1},
+		// someone else added it in between, their failures count too
+		{"add raced", map[string][]byte{}, 1, 2, 3},
+		{"cas conflicts", map[string][]byte{"k": []byte(`{"failures": 4}`)}, 2, 3, 5},
+		// what can't be read starts over
+		{"garbage", map[string][]byte{"k": []byte("{")}, 0, 1, 1},
+	}
+	for _, test := range tests {
+		m := &fakeMemcache{items: test.items, conflicts: test.conflicts, other: limitState{Failures: 2}}
+		s := &memcacheLimitStore{client: m}
+		calls := 0
+		st, err := s.update("k", func(st *limitState) {
+			calls++
+			fail(st)
+		})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if calls != test.calls || st.Failures != test.failures || stored(m) != test.failures {
+			t.Errorf("%s: fn called %d times, %d failures returned and %d stored, want %d and %d", test.name, calls, st.Failures, stored(m), test.calls, test.failures)
+		}
+	}
+
+	m := &fakeMemcache{items: map[string][]byte{"k": []byte("{}")}, conflicts: casRetries}
+	calls := 0
+	_, err := (&memcacheLimitStore{client: m}).update("k", func(st *limitState) {
+		calls++
+		fail(st)
+	})
+	if err == nil || !strings.Contains(err.Error(), "contention") || calls != casRetries {
+		t.Errorf("always conflicting: %v after %d calls", err, calls)
+	}
+
+	m = &fakeMemcache{getErr: errors.New("connection refused")}
+	if _, err := (&memcacheLimitStore{client: m}).update("k", fail); err != m.getErr {
+		t.Errorf("failing server: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"strings"
+)
+
+// memos.is_private holds the visibility of a memo. Hidden memos are public
+// ones an admin took down; only the owner and admins can still open them.
+const (
+	visibilityPublic   = 0
+	visibilityPrivate  = 1
+	visibilityUnlisted = 2
+	visibilityHidden   = 3
+)
+
+func parseVisibility(s string) int {
+	switch s {
+	case "1":
+		return visibilityPrivate
+	case "2":
+		return visibilityUnlisted
+	}
+	return visibilityPublic
+}
+
+func newShareToken() string {
+	return fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+}
+
+func parseReaders(s string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	}) {
+		names = append(names, name)
+	}
+	return names
+}
+
+// canReadMemo tells whether user may open the memo through /memo/{id}.
+// Unlisted memos are only reachable there by their owner and readers, and
+// through /shared/{token} by anyone holding the link.
+func canReadMemo(dbConn *sql.DB, memo *Memo, user *User) (bool, error) {
+	if memo.IsPrivate == visibilityPublic {
+		return true, nil
+	}
+	if user == nil {
+		return false, nil
+	}
+	if user.Id == memo.User {
+		return true, nil
+	}
+	if memo.IsPrivate == visibilityHidden {
+		return user.IsAdmin, nil
+	}
+	var n int
+	err := dbConn.QueryRow("SELECT count(*) FROM memo_readers WHERE memo=? AND user=?", memo.Id, user.Id).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func loadReaders(dbConn *sql.DB, memo *Memo) error {
+	rows, err := dbConn.Query("SELECT users.username FROM memo_readers JOIN users ON (memo_readers.user = users.id) WHERE memo_readers.memo=? ORDER BY users.username", memo.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	memo.Readers = make([]string, 0)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		memo.Readers = append(memo.Readers, name)
+	}
+	return nil
+}
+
+// loadSharing fills Readers and ShareToken of all memos of one owner at once.
+func loadSharing(dbConn *sql.DB, owner int, memos Memos) error {
+	byId := make(map[int]*Memo)
+	for _, memo := range memos {
+		memo.Readers = make([]string, 0)
+		byId[memo.Id] = memo
+	}
+	rows, err := dbConn.Query("SELECT memo_readers.memo, users.username FROM memo_readers JOIN memos ON (memo_readers.memo = memos.id) JOIN users ON (memo_readers.user = users.id) WHERE memos.user=? ORDER BY users.username", owner)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var memoId int
+		var name string
+		rows.Scan(&memoId, &name)
+		if memo, ok := byId[memoId]; ok {
+			memo.Readers = append(memo.Readers, name)
+		}
+	}
+	rows.Close()
+	rows, err = dbConn.Query("SELECT memo_shares.memo, memo_shares.token FROM memo_shares JOIN memos ON (memo_shares.memo = memos.id) WHERE memos.user=?", owner)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var memoId int
+		var token string
+		rows.Scan(&memoId, &token)
+		if memo, ok := byId[memoId]; ok {
+			memo.ShareToken = token
+		}
+	}
+	rows.Close()
+	return nil
+}
+
+func loadShareToken(dbConn *sql.DB, memo *Memo) error {
+	err := dbConn.QueryRow("SELECT token FROM memo_shares WHERE memo=?", memo.Id).Scan(&memo.ShareToken)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// setSharing applies the visibility, creates the share token on first use
+// and replaces the reader list. It returns the names that matched no user.
+func setSharing(dbConn *sql.DB, memoId int64, owner int, visibility int, readers []string) ([]string, error) {
+	if _, err := dbConn.Exec("UPDATE memos SET is_private=? WHERE id=?", visibility, memoId); err != nil {
+		return nil, err
+	}
+	if visibility == visibilityUnlisted {
+		if _, err := dbConn.Exec("INSERT IGNORE INTO memo_shares (memo, token) VALUES (?, ?)", memoId, newShareToken()); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dbConn.Exec("DELETE FROM memo_readers WHERE memo=?", memoId); err != nil {
+		return nil, err
+	}
+	unknown := make([]string, 0)
+	for _, name := range readers {
+		var id int
+		err := dbConn.QueryRow("SELECT id FROM users WHERE username=?", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			unknown = append(unknown, name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if id == owner {
+			continue
+		}
+		if _, err := dbConn.Exec("INSERT IGNORE INTO memo_readers (memo, user, created_at) VALUES (?, ?, now())", memoId, id); err != nil {
+			return nil, err
+		}
+	}
+	return unknown, nil
+}
+
+func sharedMemoHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	baseUrl := prepareHandler(w, r)
+	token := mux.Vars(r)["token"]
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+
+	memo := &Memo{}
+	err = dbConn.QueryRow(
+		"SELECT memos.id, memos.user, memos.content, memos.is_private, memos.created_at, memos.updated_at FROM memo_shares JOIN memos ON (memo_shares.memo = memos.id) WHERE memo_shares.token=? AND memos.is_private=?",
+		token, visibilityUnlisted,
+	).Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	renderMemo(w, r, dbConn, session, baseUrl, user, memo, baseUrl.String()+"/shared/"+token+"/file/")
+}
+
+func memoShareHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, dbConn, session)
+	if user == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	memo := &Memo{}
+	err = dbConn.QueryRow("SELECT id, user, is_private FROM memos WHERE id=?", mux.Vars(r)["memo_id"]).Scan(&memo.Id, &memo.User, &memo.IsPrivate)
+	if err == sql.ErrNoRows || (err == nil && memo.User != user.Id) {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if memo.IsPrivate == visibilityHidden {
+		addFlash(session, FlashError, translate(requestLocale(r, user), "flash.memo_hidden"))
+		if err := session.Save(r, w); err != nil {
+			serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/memo/%d", memo.Id), http.StatusFound)
+		return
+	}
+
+	unknown, err := setSharing(dbConn, int64(memo.Id), user.Id, parseVisibility(r.FormValue("is_private")), parseReaders(r.FormValue("readers")))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	pages.invalidate()
+	if len(unknown) > 0 {
+		addFlash(session, FlashWarning, translate(requestLocale(r, user), "flash.no_such_user", strings.Join(unknown, ", ")))
+	} else {
+		addFlash(session, FlashInfo, translate(requestLocale(r, user), "flash.sharing_updated"))
+	}
+	if err := session.Save(r, w); err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/memo/%d", memo.Id), http.StatusFound)
+}
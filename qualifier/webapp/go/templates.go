@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+)
+
+// templateSet is the built-in templates with the theme's on top of them. A
+// theme file only needs to define the templates it changes, e.g. base_top.
+// With reload set, the files are checked on every render and parsed again
+// when any of them changed, so templates can be edited without a restart.
+type templateSet struct {
+	base        fs.FS
+	theme       fs.FS
+	reload      bool
+	mu          sync.Mutex
+	t           *template.Template
+	fingerprint string
+}
+
+// newTemplateSet parses the templates in base, which is either the embedded
+// copy or a directory on disk, and then those in the theme directory if any.
+func newTemplateSet(base fs.FS, theme string, reload bool) (*templateSet, error) {
+	s := &templateSet{base: base, reload: reload}
+	if theme != "" {
+		s.theme = os.DirFS(theme)
+	}
+	t, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	s.t = t
+	s.fingerprint = s.files()
+	return s, nil
+}
+
+func (s *templateSet) parse() (*template.Template, error) {
+	t, err := template.New("tmpl").Funcs(fmap).ParseFS(s.base, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	if s.theme == nil {
+		return t, nil
+	}
+	if overrides, _ := fs.Glob(s.theme, "*.html"); len(overrides) == 0 {
+		return t, nil
+	}
+	return t.ParseFS(s.theme, "*.html")
+}
+
+// files describes the names and modification times of all template files,
+// so adding or removing a theme file counts as a change too.
+func (s *templateSet) files() string {
+	var b bytes.Buffer
+	for i, fsys := range []fs.FS{s.base, s.theme} {
+		if fsys == nil {
+			continue
+		}
+		names, _ := fs.Glob(fsys, "*.html")
+		for _, name := range names {
+			if fi, err := fs.Stat(fsys, name); err == nil {
+				fmt.Fprintf(&b, "%d %s %d\n", i, name, fi.ModTime().UnixNano())
+			}
+		}
+	}
+	return b.String()
+}
+
+func (s *templateSet) get() *template.Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.reload {
+		return s.t
+	}
+	if fingerprint := s.files(); fingerprint != s.fingerprint {
+		// keep serving the old set while a broken edit is being fixed
+		if t, err := s.parse(); err != nil {
+			log.Printf("can't reload templates: %v", err)
+		} else {
+			log.Printf("templates reloaded")
+			s.t = t
+			s.fingerprint = fingerprint
+		}
+	}
+	return s.t
+}
+
+func (s *templateSet) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	return s.get().ExecuteTemplate(w, name, data)
+}